@@ -0,0 +1,374 @@
+// p3pctl - command line client for p3p. Works directly on a store path
+// (-store), or against a running p3pd (default).
+//
+// In direct mode account name is also the path it is reachable on, the
+// same default that p3pd uses. Accounts are opened mini (except for tail,
+// which has to receive and store messages), events are only queued and
+// p3pd relays them once it is started on the store again. The store is
+// locked while p3pctl works on it, p3pctl refuses to run while p3pd holds
+// it.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"git.mrcyjanek.net/p3pch4t/p3pgo/lib/control"
+	"git.mrcyjanek.net/p3pch4t/p3pgo/lib/core"
+)
+
+const usage = `usage: p3pctl [flags] <command> [args]
+
+commands:
+  accounts                                   list accounts (daemon only)
+  create-account <name> <username> [email]   create an identity
+  identity <account>                         print public key and fingerprint
+  add-contact <account> <url>                discover and add a contact
+  contacts <account>                         list contacts
+  conversations <account>                    list conversations
+  send <account> <contactId> <text...>       send a text message
+  messages <account> <contactId>             print messages, oldest first
+  tail <account>                             follow incoming messages
+  outbox <account>                           list queued events
+  retry <account> <queuedEventId>            relay queued event now
+
+flags:
+`
+
+var (
+	storePath = flag.String("store", "", "work directly on this store path, instead of talking to p3pd")
+	daemonURL = flag.String("daemon", "http://127.0.0.1:3894", "control API of p3pd")
+	token     = flag.String("token", os.Getenv("P3PCTL_TOKEN"), "control API token (or $P3PCTL_TOKEN)")
+	tokenFile = flag.String("token-file", "", "read control API token from file")
+	jsonOut   = flag.Bool("json", false, "print JSON instead of tables")
+	bitSize   = flag.Int("bits", 4096, "create-account: key size")
+	endpoint  = flag.String("endpoint", "", "create-account: endpoint to advertise")
+	port      = flag.Int("port", core.DefaultLocalServerPort, "tail, direct mode: local server port to receive events on")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	api, closeAPI, err := openAPI(args)
+	if err != nil {
+		fatal(err)
+	}
+	err = run(api, args)
+	closeAPI()
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "p3pctl:", err)
+	os.Exit(1)
+}
+
+// openAPI - Service opened on -store, or Client of p3pd.
+func openAPI(args []string) (control.API, func(), error) {
+	if *storePath == "" {
+		t := *token
+		if *tokenFile != "" {
+			b, err := os.ReadFile(*tokenFile)
+			if err != nil {
+				return nil, nil, err
+			}
+			t = strings.TrimSpace(string(b))
+		}
+		return control.NewClient(*daemonURL, t), func() {}, nil
+	}
+	// core logs a lot, that's not what a CLI user wants to see.
+	core.LOG_TO_CONSOLE = false
+	if args[0] == "accounts" {
+		return nil, nil, fmt.Errorf("accounts needs p3pd, account names are not stored in %s", *storePath)
+	}
+	unlock, err := control.LockStore(*storePath)
+	if errors.Is(err, control.ErrStoreLocked) {
+		return nil, nil, fmt.Errorf("%s is used by p3pd, run p3pctl without -store", *storePath)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	svc := control.NewService(*storePath, args[0] != "tail")
+	var ls *core.LocalServer
+	if args[0] == "tail" {
+		// We have to be reachable to receive anything.
+		ls = core.NewLocalServer("", *port)
+		err := ls.Start()
+		if err != nil {
+			unlock()
+			return nil, nil, err
+		}
+		svc.Accounts = ls.Accounts
+	}
+	if len(args) > 1 && args[0] != "create-account" {
+		_, err := svc.OpenAccount(args[1], args[1])
+		if err != nil {
+			if ls != nil {
+				_ = ls.Shutdown(context.Background())
+			}
+			svc.Close()
+			unlock()
+			return nil, nil, err
+		}
+	}
+	return svc, func() {
+		if ls != nil {
+			err := ls.Shutdown(context.Background())
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		svc.Close()
+		unlock()
+	}, nil
+}
+
+func need(args []string, n int) error {
+	if len(args) < n+1 {
+		return fmt.Errorf("%s: expected %d arguments, see p3pctl -h", args[0], n)
+	}
+	return nil
+}
+
+func parseID(s string) (uint, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id: %s", s)
+	}
+	return uint(id), nil
+}
+
+func run(api control.API, args []string) error {
+	switch args[0] {
+	case "accounts":
+		accounts, err := api.ListAccounts()
+		if err != nil {
+			return err
+		}
+		return output(accounts, func(w io.Writer) {
+			fmt.Fprintln(w, "NAME\tPATH\tUSERNAME\tKEYID\tENDPOINT")
+			for _, acc := range accounts {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", acc.Name, acc.Path, acc.Username, acc.KeyID, acc.Endpoint)
+			}
+		})
+	case "create-account":
+		if err := need(args, 2); err != nil {
+			return err
+		}
+		req := control.CreateAccountRequest{Name: args[1], Path: args[1], Username: args[2], BitSize: *bitSize, Endpoint: *endpoint}
+		if len(args) > 3 {
+			req.Email = args[3]
+		}
+		acc, err := api.CreateAccount(req)
+		if err != nil {
+			return err
+		}
+		return output(acc, func(w io.Writer) {
+			fmt.Fprintf(w, "created %s (%s)\n", acc.Name, acc.KeyID)
+		})
+	case "identity":
+		if err := need(args, 1); err != nil {
+			return err
+		}
+		identity, err := api.GetIdentity(args[1])
+		if err != nil {
+			return err
+		}
+		return output(identity, func(w io.Writer) {
+			fmt.Fprintf(w, "Fingerprint: %s\nKeyID: %s\n\n%s\n", identity.Fingerprint, identity.KeyID, identity.PublicKey)
+		})
+	case "add-contact":
+		if err := need(args, 2); err != nil {
+			return err
+		}
+		contact, err := api.AddContact(args[1], control.AddContactRequest{URL: args[2]})
+		if err != nil {
+			return err
+		}
+		return output(contact, func(w io.Writer) {
+			fmt.Fprintf(w, "added %s (id: %d, keyid: %s)\n", contact.Username, contact.ID, contact.KeyID)
+		})
+	case "contacts":
+		if err := need(args, 1); err != nil {
+			return err
+		}
+		contacts, err := api.ListContacts(args[1])
+		if err != nil {
+			return err
+		}
+		return output(contacts, func(w io.Writer) {
+			fmt.Fprintln(w, "ID\tUSERNAME\tKEYID\tENDPOINT")
+			for _, c := range contacts {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", c.ID, c.Username, c.KeyID, c.Endpoint)
+			}
+		})
+	case "conversations":
+		if err := need(args, 1); err != nil {
+			return err
+		}
+		conversations, err := api.ListConversations(args[1])
+		if err != nil {
+			return err
+		}
+		return output(conversations, func(w io.Writer) {
+			fmt.Fprintln(w, "ID\tUSERNAME\tMESSAGES\tLAST")
+			for _, c := range conversations {
+				fmt.Fprintf(w, "%d\t%s\t%d\t%s\n", c.Contact.ID, c.Contact.Username, c.MessageCount, oneLine(c.LastMessage))
+			}
+		})
+	case "send":
+		if err := need(args, 3); err != nil {
+			return err
+		}
+		contactID, err := parseID(args[2])
+		if err != nil {
+			return err
+		}
+		return api.SendMessage(args[1], contactID, control.SendMessageRequest{Text: strings.Join(args[3:], " ")})
+	case "messages":
+		if err := need(args, 2); err != nil {
+			return err
+		}
+		contactID, err := parseID(args[2])
+		if err != nil {
+			return err
+		}
+		msgs, err := api.ListMessages(args[1], contactID)
+		if err != nil {
+			return err
+		}
+		return output(msgs, func(w io.Writer) {
+			for i := len(msgs) - 1; i >= 0; i-- {
+				direction := ">"
+				if msgs[i].Incoming {
+					direction = "<"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", msgs[i].CreatedAt.Format(time.DateTime), direction, oneLine(msgs[i].Text))
+			}
+		})
+	case "tail":
+		if err := need(args, 1); err != nil {
+			return err
+		}
+		return tail(api, args[1])
+	case "outbox":
+		if err := need(args, 1); err != nil {
+			return err
+		}
+		qevts, err := api.ListQueuedEvents(args[1])
+		if err != nil {
+			return err
+		}
+		return output(qevts, func(w io.Writer) {
+			fmt.Fprintln(w, "ID\tKEYID\tENDPOINT\tTRIES\tLAST RELAYED\tFAILS\tDELAY\tSIZE")
+			for _, q := range qevts {
+				endpoint := q.Endpoint
+				if q.Pull {
+					endpoint = "(pull)"
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%d\t%d\t%d\n", q.ID, q.KeyID, endpoint, q.RelayTries,
+					q.LastRelayed.Format(time.DateTime), q.FailInRow, q.CurrentDelay, q.SizeBytes)
+			}
+		})
+	case "retry":
+		if err := need(args, 2); err != nil {
+			return err
+		}
+		id, err := parseID(args[2])
+		if err != nil {
+			return err
+		}
+		return api.RetryQueuedEvent(args[1], id)
+	}
+	return fmt.Errorf("unknown command %s, see p3pctl -h", args[0])
+}
+
+// tail - print incoming messages until interrupted.
+func tail(api control.API, account string) error {
+	names := make(map[uint]string)
+	refreshNames := func() error {
+		contacts, err := api.ListContacts(account)
+		for _, c := range contacts {
+			names[c.ID] = c.Username
+		}
+		return err
+	}
+	err := refreshNames()
+	if err != nil {
+		return err
+	}
+	notifications, cancel, err := api.Subscribe(account)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	for n := range notifications {
+		if *jsonOut {
+			b, err := json.Marshal(n)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+			continue
+		}
+		if n.Type != core.NotificationMessage {
+			continue
+		}
+		// Data is a map when it went through the daemon.
+		var msg core.NotificationMessageData
+		b, err := json.Marshal(n.Data)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(b, &msg)
+		if err != nil || !msg.Incoming {
+			continue
+		}
+		if _, ok := names[msg.UserInfoID]; !ok {
+			// contact was added after we have started.
+			_ = refreshNames()
+		}
+		name, ok := names[msg.UserInfoID]
+		if !ok {
+			name = msg.KeyID
+		}
+		fmt.Printf("%s <%s> %s\n", time.Unix(n.Time, 0).Format(time.DateTime), name, oneLine(msg.Text))
+	}
+	return nil
+}
+
+func oneLine(s string) string {
+	return strings.ReplaceAll(s, "\n", " ")
+}
+
+// output - v as JSON with -json, table otherwise.
+func output(v interface{}, table func(w io.Writer)) error {
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
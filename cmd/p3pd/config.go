@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"git.mrcyjanek.net/p3pch4t/p3pgo/lib/core"
+)
+
+// Config - p3pd configuration file.
+//
+//	{
+//	  "storePath": "/var/lib/p3pd",
+//	  "i2pHttpProxy": "http://127.0.0.1:4444",
+//	  "localServer": {"address": "127.0.0.1", "port": 3893},
+//	  "control": {"address": "127.0.0.1:3894"},
+//	  "accounts": [{"name": "main", "path": "main"}]
+//	}
+type Config struct {
+	StorePath    string            `json:"storePath"`
+	I2PHTTPProxy string            `json:"i2pHttpProxy,omitempty"`
+	LocalServer  LocalServerConfig `json:"localServer"`
+	Control      ControlConfig     `json:"control"`
+	Accounts     []AccountConfig   `json:"accounts"`
+
+	path string
+	lock sync.Mutex
+}
+
+type LocalServerConfig struct {
+	Address     string `json:"address"`
+	Port        int    `json:"port"`
+	TLSCertFile string `json:"tlsCertFile,omitempty"`
+	TLSKeyFile  string `json:"tlsKeyFile,omitempty"`
+	// I2PTunnelHost - address that the i2pd server tunnel connects
+	// from, see core.LocalServer.
+	I2PTunnelHost string `json:"i2pTunnelHost,omitempty"`
+	// LoopbackAddress - where /metrics and /stream.sse are served, has
+	// to be a loopback address. Defaults to core.DefaultLoopbackAddress.
+	LoopbackAddress string `json:"loopbackAddress,omitempty"`
+	Metrics         bool   `json:"metrics,omitempty"`
+	Stream          bool   `json:"stream,omitempty"`
+}
+
+type ControlConfig struct {
+	// Address - has to be a loopback address.
+	Address string `json:"address"`
+	// Token - if empty, TokenFile is used (and created if needed).
+	Token string `json:"token,omitempty"`
+	// TokenFile - defaults to <storePath>/control.token
+	TokenFile string `json:"tokenFile,omitempty"`
+}
+
+type AccountConfig struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{path: path}
+	err = json.Unmarshal(b, c)
+	if err != nil {
+		return nil, err
+	}
+	if c.StorePath == "" {
+		return nil, errors.New("storePath is required")
+	}
+	if c.LocalServer.Port == 0 {
+		c.LocalServer.Port = core.DefaultLocalServerPort
+	}
+	if c.Control.Address == "" {
+		c.Control.Address = "127.0.0.1:3894"
+	}
+	if c.Control.TokenFile == "" {
+		c.Control.TokenFile = filepath.Join(c.StorePath, "control.token")
+	}
+	return c, nil
+}
+
+// AddAccount - remember account that was created through the control API.
+func (c *Config) AddAccount(name string, path string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, acc := range c.Accounts {
+		if acc.Name == name {
+			return nil
+		}
+	}
+	c.Accounts = append(c.Accounts, AccountConfig{Name: name, Path: path})
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, b, 0600)
+}
+
+// ControlToken - token that control API clients need, generated on the
+// first start.
+func (c *Config) ControlToken() (string, error) {
+	if c.Control.Token != "" {
+		return c.Control.Token, nil
+	}
+	b, err := os.ReadFile(c.Control.TokenFile)
+	if err == nil && len(strings.TrimSpace(string(b))) != 0 {
+		return strings.TrimSpace(string(b)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	token, err := core.GenerateRandomStringURLSafe(48)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(c.Control.TokenFile), 0750)
+	if err != nil {
+		return "", err
+	}
+	return token, os.WriteFile(c.Control.TokenFile, []byte(token+"\n"), 0600)
+}
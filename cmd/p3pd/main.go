@@ -0,0 +1,114 @@
+// p3pd - headless p3p node. Opens accounts listed in the config file,
+// relays their events, serves them on the local server and exposes the
+// control API (see lib/control) on localhost.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"git.mrcyjanek.net/p3pch4t/p3pgo/lib/control"
+	"git.mrcyjanek.net/p3pch4t/p3pgo/lib/core"
+)
+
+func main() {
+	configPath := flag.String("config", "p3pd.json", "path to the config file")
+	flag.Parse()
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalln("Unable to load config:", err)
+	}
+	err = run(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func run(config *Config) error {
+	host, _, err := net.SplitHostPort(config.Control.Address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.New("control address has to be a loopback address")
+	}
+	token, err := config.ControlToken()
+	if err != nil {
+		return err
+	}
+	if config.I2PHTTPProxy != "" {
+		core.I2P_HTTP_PROXY = config.I2PHTTPProxy
+	}
+
+	// p3pctl -store refuses to touch the store while we hold this.
+	unlock, err := control.LockStore(config.StorePath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	ls := core.NewLocalServer(config.LocalServer.Address, config.LocalServer.Port)
+	ls.TLSCertFile = config.LocalServer.TLSCertFile
+	ls.TLSKeyFile = config.LocalServer.TLSKeyFile
+	ls.I2PTunnelHost = config.LocalServer.I2PTunnelHost
+	ls.LoopbackAddress = config.LocalServer.LoopbackAddress
+	ls.Metrics = config.LocalServer.Metrics
+	ls.Stream = config.LocalServer.Stream
+	err = ls.Start()
+	if err != nil {
+		return err
+	}
+
+	svc := control.NewService(config.StorePath, false)
+	svc.Accounts = ls.Accounts
+	svc.OnAccountCreated = func(name string, path string) {
+		err := config.AddAccount(name, path)
+		if err != nil {
+			log.Println("Unable to save account in config:", err)
+		}
+	}
+	for _, acc := range config.Accounts {
+		_, err := svc.OpenAccount(acc.Name, acc.Path)
+		if err != nil {
+			return err
+		}
+	}
+	defer svc.Close()
+
+	listener, err := net.Listen("tcp", config.Control.Address)
+	if err != nil {
+		return err
+	}
+	controlServer := &http.Server{Handler: control.Handler(svc, token)}
+	go func() {
+		err := controlServer.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("Control API stopped:", err)
+		}
+	}()
+	log.Println("p3pd: local server on", ls.Addr(), "control API on", listener.Addr().String())
+	if addr := ls.LoopbackAddr(); addr != "" {
+		log.Println("p3pd: local-only routes on", addr)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	log.Println("p3pd: shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+	err = controlServer.Shutdown(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+	return ls.Shutdown(ctx)
+}
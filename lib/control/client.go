@@ -0,0 +1,178 @@
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"git.mrcyjanek.net/p3pch4t/p3pgo/lib/core"
+)
+
+// API - operations available both directly (Service) and through a
+// running daemon (Client).
+type API interface {
+	ListAccounts() ([]Account, error)
+	CreateAccount(req CreateAccountRequest) (Account, error)
+	GetIdentity(account string) (Identity, error)
+	ListContacts(account string) ([]Contact, error)
+	AddContact(account string, req AddContactRequest) (Contact, error)
+	ListConversations(account string) ([]Conversation, error)
+	ListMessages(account string, contactID uint) ([]Message, error)
+	SendMessage(account string, contactID uint, req SendMessageRequest) error
+	ListSharedFiles(account string) ([]SharedFile, error)
+	ShareFile(account string, req ShareFileRequest) error
+	DeleteSharedFile(account string, fileID uint) error
+	ListQueuedEvents(account string) ([]QueuedEvent, error)
+	RetryQueuedEvent(account string, id uint) error
+	Subscribe(account string) (<-chan core.Notification, func(), error)
+}
+
+var _ API = (*Service)(nil)
+var _ API = (*Client)(nil)
+
+// Client - control API of a running p3pd.
+type Client struct {
+	// BaseURL - for example http://127.0.0.1:3894
+	BaseURL string
+	Token   string
+	HTTP    *http.Client
+}
+
+func NewClient(baseURL string, token string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Token: token, HTTP: http.DefaultClient}
+}
+
+func (c *Client) request(method string, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.BaseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authentication", "Bearer "+c.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var e Error
+		err = json.NewDecoder(resp.Body).Decode(&e)
+		if err != nil || e.Error == "" {
+			return nil, fmt.Errorf("control API: %s", resp.Status)
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%s: %w", strings.TrimSuffix(e.Error, ": "+ErrNotFound.Error()), ErrNotFound)
+		}
+		return nil, errors.New(e.Error)
+	}
+	return resp, nil
+}
+
+func (c *Client) do(method string, path string, body interface{}, out interface{}) error {
+	resp, err := c.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func accountPath(account string) string {
+	return "/v1/accounts/" + account
+}
+
+func (c *Client) ListAccounts() (accounts []Account, err error) {
+	return accounts, c.do("GET", "/v1/accounts", nil, &accounts)
+}
+
+func (c *Client) CreateAccount(req CreateAccountRequest) (account Account, err error) {
+	return account, c.do("POST", "/v1/accounts", req, &account)
+}
+
+func (c *Client) GetIdentity(account string) (identity Identity, err error) {
+	return identity, c.do("GET", accountPath(account)+"/identity", nil, &identity)
+}
+
+func (c *Client) ListContacts(account string) (contacts []Contact, err error) {
+	return contacts, c.do("GET", accountPath(account)+"/contacts", nil, &contacts)
+}
+
+func (c *Client) AddContact(account string, req AddContactRequest) (contact Contact, err error) {
+	return contact, c.do("POST", accountPath(account)+"/contacts", req, &contact)
+}
+
+func (c *Client) ListConversations(account string) (conversations []Conversation, err error) {
+	return conversations, c.do("GET", accountPath(account)+"/conversations", nil, &conversations)
+}
+
+func (c *Client) ListMessages(account string, contactID uint) (msgs []Message, err error) {
+	return msgs, c.do("GET", fmt.Sprintf("%s/contacts/%d/messages", accountPath(account), contactID), nil, &msgs)
+}
+
+func (c *Client) SendMessage(account string, contactID uint, req SendMessageRequest) error {
+	return c.do("POST", fmt.Sprintf("%s/contacts/%d/messages", accountPath(account), contactID), req, nil)
+}
+
+func (c *Client) ListSharedFiles(account string) (files []SharedFile, err error) {
+	return files, c.do("GET", accountPath(account)+"/files", nil, &files)
+}
+
+func (c *Client) ShareFile(account string, req ShareFileRequest) error {
+	return c.do("POST", accountPath(account)+"/files", req, nil)
+}
+
+func (c *Client) DeleteSharedFile(account string, fileID uint) error {
+	return c.do("DELETE", fmt.Sprintf("%s/files/%d", accountPath(account), fileID), nil, nil)
+}
+
+func (c *Client) ListQueuedEvents(account string) (qevts []QueuedEvent, err error) {
+	return qevts, c.do("GET", accountPath(account)+"/outbox", nil, &qevts)
+}
+
+func (c *Client) RetryQueuedEvent(account string, id uint) error {
+	return c.do("POST", fmt.Sprintf("%s/outbox/%d/retry", accountPath(account), id), nil, nil)
+}
+
+// Subscribe - follow the notifications stream, the channel is closed
+// when the stream ends.
+func (c *Client) Subscribe(account string) (<-chan core.Notification, func(), error) {
+	resp, err := c.request("GET", accountPath(account)+"/notifications", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch := make(chan core.Notification, core.NotifySubscriberBuffer)
+	go func() {
+		defer close(ch)
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var n core.Notification
+			if json.Unmarshal([]byte(data), &n) == nil {
+				ch <- n
+			}
+		}
+	}()
+	return ch, func() { resp.Body.Close() }, nil
+}
@@ -0,0 +1,223 @@
+package control
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.mrcyjanek.net/p3pch4t/p3pgo/lib/core"
+	"github.com/go-chi/chi/v5"
+)
+
+// Handler - JSON control API of s, every request has to carry token in
+// Authentication header.
+//
+// GET    /v1/accounts
+// POST   /v1/accounts
+// GET    /v1/accounts/{account}/identity
+// GET    /v1/accounts/{account}/contacts
+// POST   /v1/accounts/{account}/contacts
+// GET    /v1/accounts/{account}/conversations
+// GET    /v1/accounts/{account}/contacts/{contact}/messages
+// POST   /v1/accounts/{account}/contacts/{contact}/messages
+// GET    /v1/accounts/{account}/files
+// POST   /v1/accounts/{account}/files
+// DELETE /v1/accounts/{account}/files/{file}
+// GET    /v1/accounts/{account}/outbox
+// POST   /v1/accounts/{account}/outbox/{event}/retry
+// GET    /v1/accounts/{account}/notifications (text/event-stream)
+func Handler(s *Service, token string) http.Handler {
+	r := chi.NewRouter()
+	r.Use(authenticate(token))
+	r.Get("/v1/accounts", func(w http.ResponseWriter, r *http.Request) {
+		accounts, err := s.ListAccounts()
+		respond(w, accounts, err)
+	})
+	r.Post("/v1/accounts", func(w http.ResponseWriter, r *http.Request) {
+		var req CreateAccountRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		account, err := s.CreateAccount(req)
+		respond(w, account, err)
+	})
+	r.Get("/v1/accounts/{account}/identity", func(w http.ResponseWriter, r *http.Request) {
+		identity, err := s.GetIdentity(chi.URLParam(r, "account"))
+		respond(w, identity, err)
+	})
+	r.Get("/v1/accounts/{account}/contacts", func(w http.ResponseWriter, r *http.Request) {
+		contacts, err := s.ListContacts(chi.URLParam(r, "account"))
+		respond(w, contacts, err)
+	})
+	r.Post("/v1/accounts/{account}/contacts", func(w http.ResponseWriter, r *http.Request) {
+		var req AddContactRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		contact, err := s.AddContact(chi.URLParam(r, "account"), req)
+		respond(w, contact, err)
+	})
+	r.Get("/v1/accounts/{account}/conversations", func(w http.ResponseWriter, r *http.Request) {
+		conversations, err := s.ListConversations(chi.URLParam(r, "account"))
+		respond(w, conversations, err)
+	})
+	r.Get("/v1/accounts/{account}/contacts/{contact}/messages", func(w http.ResponseWriter, r *http.Request) {
+		contactID, ok := urlID(w, r, "contact")
+		if !ok {
+			return
+		}
+		msgs, err := s.ListMessages(chi.URLParam(r, "account"), contactID)
+		respond(w, msgs, err)
+	})
+	r.Post("/v1/accounts/{account}/contacts/{contact}/messages", func(w http.ResponseWriter, r *http.Request) {
+		contactID, ok := urlID(w, r, "contact")
+		if !ok {
+			return
+		}
+		var req SendMessageRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		err := s.SendMessage(chi.URLParam(r, "account"), contactID, req)
+		respond(w, struct{}{}, err)
+	})
+	r.Get("/v1/accounts/{account}/files", func(w http.ResponseWriter, r *http.Request) {
+		files, err := s.ListSharedFiles(chi.URLParam(r, "account"))
+		respond(w, files, err)
+	})
+	r.Post("/v1/accounts/{account}/files", func(w http.ResponseWriter, r *http.Request) {
+		var req ShareFileRequest
+		if !decode(w, r, &req) {
+			return
+		}
+		err := s.ShareFile(chi.URLParam(r, "account"), req)
+		respond(w, struct{}{}, err)
+	})
+	r.Delete("/v1/accounts/{account}/files/{file}", func(w http.ResponseWriter, r *http.Request) {
+		fileID, ok := urlID(w, r, "file")
+		if !ok {
+			return
+		}
+		err := s.DeleteSharedFile(chi.URLParam(r, "account"), fileID)
+		respond(w, struct{}{}, err)
+	})
+	r.Get("/v1/accounts/{account}/outbox", func(w http.ResponseWriter, r *http.Request) {
+		qevts, err := s.ListQueuedEvents(chi.URLParam(r, "account"))
+		respond(w, qevts, err)
+	})
+	r.Post("/v1/accounts/{account}/outbox/{event}/retry", func(w http.ResponseWriter, r *http.Request) {
+		eventID, ok := urlID(w, r, "event")
+		if !ok {
+			return
+		}
+		err := s.RetryQueuedEvent(chi.URLParam(r, "account"), eventID)
+		respond(w, struct{}{}, err)
+	})
+	r.Get("/v1/accounts/{account}/notifications", func(w http.ResponseWriter, r *http.Request) {
+		notifications, cancel, err := s.Subscribe(chi.URLParam(r, "account"))
+		if err != nil {
+			respond(w, nil, err)
+			return
+		}
+		defer cancel()
+		streamNotifications(w, r, notifications)
+	})
+	return r
+}
+
+func streamNotifications(w http.ResponseWriter, r *http.Request, notifications <-chan core.Notification) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, Error{Error: "streaming is not supported"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepAlive := time.NewTicker(core.StreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err := fmt.Fprint(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+		case n, ok := <-notifications:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(n)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", n.Type, b)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func authenticate(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := strings.TrimPrefix(r.Header.Get("Authentication"), "Bearer ")
+			if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+				writeJSON(w, http.StatusUnauthorized, Error{Error: "invalid token"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func urlID(w http.ResponseWriter, r *http.Request, name string) (uint, bool) {
+	id, err := strconv.ParseUint(chi.URLParam(r, name), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Error{Error: "invalid " + name + " id"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Error{Error: err.Error()})
+		return false
+	}
+	return true
+}
+
+func respond(w http.ResponseWriter, v interface{}, err error) {
+	if errors.Is(err, ErrNotFound) {
+		writeJSON(w, http.StatusNotFound, Error{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Error{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println(err)
+	}
+}
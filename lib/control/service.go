@@ -0,0 +1,404 @@
+// Package control - operations on a set of p3p accounts, shared by the
+// p3pd daemon (served as JSON over HTTP) and p3pctl.
+package control
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"git.mrcyjanek.net/p3pch4t/p3pgo/lib/core"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// MinBitSize and MaxBitSize - key sizes that CreateAccount accepts.
+const (
+	MinBitSize = 1024
+	MaxBitSize = 8192
+)
+
+// ErrStoreLocked - store path is used by another process, see LockStore.
+var ErrStoreLocked = errors.New("store is locked by another process")
+
+// Service - accounts opened from a single store path.
+type Service struct {
+	StorePath string
+	// IsMini - open accounts without EventQueueRunner and SyncFolderRunner.
+	IsMini bool
+	// OnAccountCreated - called after CreateAccount, p3pd uses it to
+	// persist the account in it's config.
+	OnAccountCreated func(name string, path string)
+	// Accounts - registry of the LocalServer that serves opened accounts,
+	// nil keeps them local.
+	Accounts *core.AccountRegistry
+
+	lock     sync.Mutex
+	accounts map[string]*core.PrivateInfoS
+}
+
+func NewService(storePath string, isMini bool) *Service {
+	return &Service{StorePath: storePath, IsMini: isMini, accounts: make(map[string]*core.PrivateInfoS)}
+}
+
+// OpenAccount - open (or create the database of) account name, reachable
+// on path in the local server.
+func (s *Service) OpenAccount(name string, path string) (*core.PrivateInfoS, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if name == "" || path == "" {
+		return nil, errors.New("account name and path are required")
+	}
+	if _, ok := s.accounts[name]; ok {
+		return nil, fmt.Errorf("account %s is already open", name)
+	}
+	for _, pi := range s.accounts {
+		if pi.EndpointPath == path {
+			return nil, fmt.Errorf("path %s is already used", path)
+		}
+	}
+	if s.Accounts != nil {
+		if _, ok := s.Accounts.ByPath(path); ok {
+			return nil, fmt.Errorf("path %s is already used", path)
+		}
+	}
+	pi := core.OpenPrivateInfo(s.StorePath, name, path, s.IsMini)
+	if s.Accounts != nil {
+		s.Accounts.Register(path, pi)
+	}
+	s.accounts[name] = pi
+	return pi, nil
+}
+
+// Close - close all accounts.
+func (s *Service) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for name, pi := range s.accounts {
+		err := core.ClosePrivateInfo(pi)
+		if err != nil {
+			log.Println("Unable to close", name, err)
+		}
+		delete(s.accounts, name)
+	}
+}
+
+// closeAccount - close and forget account name, it is unregistered from
+// the LocalServer as well.
+func (s *Service) closeAccount(name string) {
+	s.lock.Lock()
+	pi, ok := s.accounts[name]
+	delete(s.accounts, name)
+	s.lock.Unlock()
+	if !ok {
+		return
+	}
+	err := core.ClosePrivateInfo(pi)
+	if err != nil {
+		log.Println("Unable to close", name, err)
+	}
+}
+
+func (s *Service) account(name string) (*core.PrivateInfoS, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pi, ok := s.accounts[name]
+	if !ok {
+		return nil, fmt.Errorf("account %s: %w", name, ErrNotFound)
+	}
+	return pi, nil
+}
+
+func (s *Service) contact(pi *core.PrivateInfoS, id uint) (*core.UserInfo, error) {
+	ui, err := pi.GetUserInfoByID(id)
+	if err != nil {
+		return nil, fmt.Errorf("contact %d: %w", id, ErrNotFound)
+	}
+	return ui, nil
+}
+
+func toAccount(name string, pi *core.PrivateInfoS) Account {
+	acc := Account{
+		Name:     name,
+		Path:     pi.EndpointPath,
+		Username: pi.Username,
+		Endpoint: string(pi.Endpoint),
+		Ready:    pi.IsAccountReady(),
+	}
+	if acc.Ready {
+		acc.KeyID = pi.GetKeyID()
+	}
+	return acc
+}
+
+func toContact(ui *core.UserInfo) Contact {
+	return Contact{ID: ui.ID, KeyID: ui.GetKeyID(), Username: ui.Username, Endpoint: string(ui.Endpoint), State: ui.State}
+}
+
+func (s *Service) ListAccounts() ([]Account, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	accounts := []Account{}
+	for name, pi := range s.accounts {
+		accounts = append(accounts, toAccount(name, pi))
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Name < accounts[j].Name })
+	return accounts, nil
+}
+
+// CreateAccount - open a new account and generate it's keys.
+func (s *Service) CreateAccount(req CreateAccountRequest) (Account, error) {
+	if req.Username == "" {
+		return Account{}, errors.New("username is required")
+	}
+	if req.Path == "" {
+		req.Path = req.Name
+	}
+	if req.BitSize == 0 {
+		req.BitSize = 4096
+	}
+	if req.BitSize < MinBitSize || req.BitSize > MaxBitSize {
+		return Account{}, fmt.Errorf("bitSize has to be between %d and %d", MinBitSize, MaxBitSize)
+	}
+	pi, err := s.OpenAccount(req.Name, req.Path)
+	if err != nil {
+		return Account{}, err
+	}
+	if !pi.IsAccountReady() {
+		err = pi.Create(req.Username, req.Email, req.BitSize)
+		if err != nil {
+			// Don't keep half created account open, it would be
+			// "already open" for every retry.
+			s.closeAccount(req.Name)
+			return Account{}, err
+		}
+	}
+	if req.Endpoint != "" {
+		pi.Endpoint = core.Endpoint(req.Endpoint)
+		pi.DB.Save(pi)
+	}
+	if s.OnAccountCreated != nil {
+		s.OnAccountCreated(req.Name, req.Path)
+	}
+	return toAccount(req.Name, pi), nil
+}
+
+// GetIdentity - our public key, to be shared with contacts.
+func (s *Service) GetIdentity(account string) (Identity, error) {
+	pi, err := s.account(account)
+	if err != nil {
+		return Identity{}, err
+	}
+	if !pi.IsAccountReady() {
+		return Identity{}, fmt.Errorf("account %s has no keys yet", account)
+	}
+	key, err := crypto.NewKeyFromArmored(pi.PublicKey)
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{
+		PublicKey:   pi.PublicKey,
+		Fingerprint: strings.ToLower(key.GetFingerprint()),
+		KeyID:       pi.GetKeyID(),
+	}, nil
+}
+
+func (s *Service) ListContacts(account string) ([]Contact, error) {
+	pi, err := s.account(account)
+	if err != nil {
+		return nil, err
+	}
+	contacts := []Contact{}
+	for _, ui := range pi.GetAllUserInfo() {
+		contacts = append(contacts, toContact(ui))
+	}
+	return contacts, nil
+}
+
+// AddContact - add contact and send them our introduce event.
+func (s *Service) AddContact(account string, req AddContactRequest) (Contact, error) {
+	pi, err := s.account(account)
+	if err != nil {
+		return Contact{}, err
+	}
+	if req.URL != "" {
+		endpoint := core.Endpoint(req.URL)
+		dui, err := core.DiscoverUserByURL(endpoint.GetHost())
+		if err != nil {
+			return Contact{}, err
+		}
+		req.PublicKey = dui.PublicKey
+		req.Endpoint = dui.Endpoint
+		if req.Username == "" {
+			req.Username = dui.Name
+		}
+	}
+	if req.PublicKey == "" {
+		return Contact{}, errors.New("url or publicKey is required")
+	}
+	ui, err := pi.CreateUserByPublicKey(req.PublicKey, req.Username, core.Endpoint(req.Endpoint), true)
+	if err != nil {
+		return Contact{}, err
+	}
+	return toContact(ui), nil
+}
+
+func (s *Service) ListConversations(account string) ([]Conversation, error) {
+	pi, err := s.account(account)
+	if err != nil {
+		return nil, err
+	}
+	conversations := []Conversation{}
+	for _, ui := range pi.GetAllUserInfo() {
+		msgs := pi.GetMessagesByUserInfo(ui)
+		c := Conversation{Contact: toContact(ui), MessageCount: len(msgs)}
+		if len(msgs) != 0 {
+			c.LastMessage = msgs[0].Body
+			c.LastMessageAt = msgs[0].CreatedAt
+		}
+		conversations = append(conversations, c)
+	}
+	sort.SliceStable(conversations, func(i, j int) bool {
+		return conversations[i].LastMessageAt.After(conversations[j].LastMessageAt)
+	})
+	return conversations, nil
+}
+
+// ListMessages - messages exchanged with contact, newest first.
+func (s *Service) ListMessages(account string, contactID uint) ([]Message, error) {
+	pi, err := s.account(account)
+	if err != nil {
+		return nil, err
+	}
+	ui, err := s.contact(pi, contactID)
+	if err != nil {
+		return nil, err
+	}
+	msgs := []Message{}
+	for _, msg := range pi.GetMessagesByUserInfo(ui) {
+		msgs = append(msgs, Message{ID: msg.ID, Incoming: msg.Incoming, Text: msg.Body, CreatedAt: msg.CreatedAt})
+	}
+	return msgs, nil
+}
+
+func (s *Service) SendMessage(account string, contactID uint, req SendMessageRequest) error {
+	pi, err := s.account(account)
+	if err != nil {
+		return err
+	}
+	ui, err := s.contact(pi, contactID)
+	if err != nil {
+		return err
+	}
+	if req.Text == "" {
+		return errors.New("text is required")
+	}
+	return pi.SendMessage(ui, core.MessageTypeText, req.Text)
+}
+
+func toSharedFile(ui *core.UserInfo, sf *core.SharedFile) SharedFile {
+	return SharedFile{
+		ID:        sf.ID,
+		ContactID: ui.ID,
+		FilePath:  sf.FilePath,
+		SizeBytes: sf.SizeBytes,
+		Sha512Sum: sf.Sha512Sum,
+		LastEdit:  sf.LastEdit,
+	}
+}
+
+// ListSharedFiles - files that we share with our contacts.
+func (s *Service) ListSharedFiles(account string) ([]SharedFile, error) {
+	pi, err := s.account(account)
+	if err != nil {
+		return nil, err
+	}
+	files := []SharedFile{}
+	for _, ui := range pi.GetAllUserInfo() {
+		for _, sf := range pi.GetSharedFiles(ui) {
+			files = append(files, toSharedFile(ui, sf))
+		}
+	}
+	return files, nil
+}
+
+func (s *Service) ShareFile(account string, req ShareFileRequest) error {
+	pi, err := s.account(account)
+	if err != nil {
+		return err
+	}
+	ui, err := s.contact(pi, req.ContactID)
+	if err != nil {
+		return err
+	}
+	if req.RemotePath == "" {
+		req.RemotePath = "/" + filepath.Base(req.LocalPath)
+	}
+	return pi.CreateFile(ui, req.LocalPath, req.RemotePath)
+}
+
+func (s *Service) DeleteSharedFile(account string, fileID uint) error {
+	pi, err := s.account(account)
+	if err != nil {
+		return err
+	}
+	sf := pi.GetSharedFileById(fileID)
+	if sf.ID == 0 {
+		return fmt.Errorf("shared file %d: %w", fileID, ErrNotFound)
+	}
+	pi.DeleteSharedFile(sf)
+	return nil
+}
+
+func (s *Service) ListQueuedEvents(account string) ([]QueuedEvent, error) {
+	pi, err := s.account(account)
+	if err != nil {
+		return nil, err
+	}
+	qevts := []QueuedEvent{}
+	for _, qevt := range pi.GetAllQueuedEvents() {
+		es := qevt.GetEndpointStats(pi)
+		qevts = append(qevts, QueuedEvent{
+			ID:             qevt.ID,
+			Uuid:           qevt.Uuid,
+			KeyID:          qevt.KeyID,
+			Endpoint:       string(qevt.Endpoint),
+			Pull:           qevt.Pull,
+			RelayTries:     qevt.RelayTries,
+			LastRelayed:    qevt.LastRelayed,
+			SizeBytes:      len(qevt.Body),
+			FailInRow:      es.FailInRow,
+			CurrentDelay:   es.CurrentDelay,
+			LastContactOut: es.LastContactOut,
+		})
+	}
+	return qevts, nil
+}
+
+// RetryQueuedEvent - relay queued event now, error tells why it failed.
+func (s *Service) RetryQueuedEvent(account string, id uint) error {
+	pi, err := s.account(account)
+	if err != nil {
+		return err
+	}
+	qevt := pi.GetQueuedEvent(int(id))
+	if qevt.ID == 0 {
+		return fmt.Errorf("queued event %d: %w", id, ErrNotFound)
+	}
+	return pi.RetryQueuedEvent(qevt)
+}
+
+// Subscribe - notifications of account, see core.PrivateInfoS.Subscribe.
+func (s *Service) Subscribe(account string) (<-chan core.Notification, func(), error) {
+	pi, err := s.account(account)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch, cancel := pi.Subscribe()
+	return ch, cancel, nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package control
+
+// LockStore - no advisory locks here, the store is not locked at all.
+func LockStore(storePath string) (unlock func(), err error) {
+	return func() {}, nil
+}
@@ -0,0 +1,36 @@
+//go:build unix
+
+package control
+
+import (
+	"errors"
+	"os"
+	"path"
+	"syscall"
+)
+
+// LockStore - take an exclusive lock on storePath, so that only one
+// process at a time opens (and relays events of) accounts in it. Returns
+// ErrStoreLocked when another process holds it.
+func LockStore(storePath string) (unlock func(), err error) {
+	err = os.MkdirAll(storePath, 0750)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path.Join(storePath, "store.lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrStoreLocked
+		}
+		return nil, err
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package control
+
+import "testing"
+
+func TestLockStore(t *testing.T) {
+	storePath := t.TempDir()
+	unlock, err := LockStore(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LockStore(storePath)
+	if err != ErrStoreLocked {
+		t.Fatal("expected ErrStoreLocked, got", err)
+	}
+	other, err := LockStore(t.TempDir())
+	if err != nil {
+		t.Fatal("other stores should not be locked:", err)
+	}
+	other()
+	unlock()
+	unlock, err = LockStore(storePath)
+	if err != nil {
+		t.Fatal("store is still locked after unlock:", err)
+	}
+	unlock()
+}
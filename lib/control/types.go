@@ -0,0 +1,101 @@
+package control
+
+import "time"
+
+// Account - account opened by the Service.
+type Account struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Username string `json:"username"`
+	KeyID    string `json:"keyId"`
+	Endpoint string `json:"endpoint"`
+	// Ready - false until keys are generated.
+	Ready bool `json:"ready"`
+}
+
+type CreateAccountRequest struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	BitSize  int    `json:"bitSize"`
+	Endpoint string `json:"endpoint"`
+}
+
+type Contact struct {
+	ID       uint   `json:"id"`
+	KeyID    string `json:"keyId"`
+	Username string `json:"username"`
+	Endpoint string `json:"endpoint"`
+	State    string `json:"state"`
+}
+
+// AddContactRequest - either URL (discovery) or PublicKey and Endpoint.
+type AddContactRequest struct {
+	URL       string `json:"url,omitempty"`
+	PublicKey string `json:"publicKey,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Endpoint  string `json:"endpoint,omitempty"`
+}
+
+type Conversation struct {
+	Contact       Contact   `json:"contact"`
+	MessageCount  int       `json:"messageCount"`
+	LastMessage   string    `json:"lastMessage,omitempty"`
+	LastMessageAt time.Time `json:"lastMessageAt,omitempty"`
+}
+
+type Message struct {
+	ID        uint      `json:"id"`
+	Incoming  bool      `json:"incoming"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type SendMessageRequest struct {
+	Text string `json:"text"`
+}
+
+type SharedFile struct {
+	ID        uint      `json:"id"`
+	ContactID uint      `json:"contactId"`
+	FilePath  string    `json:"filePath"`
+	SizeBytes int64     `json:"sizeBytes"`
+	Sha512Sum string    `json:"sha512sum"`
+	LastEdit  time.Time `json:"lastEdit"`
+}
+
+type ShareFileRequest struct {
+	ContactID uint   `json:"contactId"`
+	LocalPath string `json:"localPath"`
+	// RemotePath - path that the contact will see, defaults to the base
+	// name of LocalPath.
+	RemotePath string `json:"remotePath,omitempty"`
+}
+
+type Identity struct {
+	PublicKey   string `json:"publicKey"`
+	Fingerprint string `json:"fingerprint"`
+	KeyID       string `json:"keyId"`
+}
+
+// QueuedEvent - event waiting to be relayed, along with the state of it's
+// endpoint.
+type QueuedEvent struct {
+	ID          uint      `json:"id"`
+	Uuid        string    `json:"uuid"`
+	KeyID       string    `json:"keyId"`
+	Endpoint    string    `json:"endpoint"`
+	Pull        bool      `json:"pull"`
+	RelayTries  int       `json:"relayTries"`
+	LastRelayed time.Time `json:"lastRelayed"`
+	SizeBytes   int       `json:"sizeBytes"`
+	// FailInRow and CurrentDelay - see core.EndpointStats.
+	FailInRow      int       `json:"failInRow"`
+	CurrentDelay   int       `json:"currentDelay"`
+	LastContactOut time.Time `json:"lastContactOut"`
+}
+
+type Error struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,36 @@
+package core
+
+// Capabilities are advertised in introduce events, so that we know what
+// can be used when talking to given user. Users that don't advertise
+// anything are assumed to talk the original protocol.
+const (
+	// CapabilityAck - POST response carries a signed DeliveryAck.
+	CapabilityAck = "ack"
+	// CapabilityEnvelope - encrypted events may be wrapped in a padded
+	// Envelope.
+	CapabilityEnvelope = "envelope"
+	// CapabilityDeflate - Envelope payload may be deflate compressed.
+	CapabilityDeflate = "deflate"
+	// CapabilityChunk - big events may be split into chunk events.
+	CapabilityChunk = "chunk"
+	// CapabilityFilesChanged - files.changed events are understood.
+	CapabilityFilesChanged = "files.changed"
+)
+
+// Capabilities - everything that this implementation supports.
+var Capabilities = []string{
+	CapabilityAck,
+	CapabilityEnvelope,
+	CapabilityDeflate,
+	CapabilityChunk,
+	CapabilityFilesChanged,
+}
+
+func (ui *UserInfo) HasCapability(capability string) bool {
+	for i := range ui.Capabilities {
+		if ui.Capabilities[i] == capability {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package core
+
+import (
+	"errors"
+	"log"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+)
+
+// Contact requests - strangers that introduce themselves without our
+// invite become pending contacts, they don't show up in GetAllUserInfo
+// and their messages are stored without notifying anyone until the user
+// accepts them. Events from blocked contacts are dropped before any
+// callback runs.
+
+const (
+	UserInfoStatePending  = "pending"
+	UserInfoStateAccepted = "accepted"
+	// UserInfoStateRejected - request was declined, further introduce
+	// events are ignored unless they carry a valid invite token.
+	UserInfoStateRejected = "rejected"
+	UserInfoStateBlocked  = "blocked"
+)
+
+// GetUserInfoByState - contacts in given state, oldest first.
+func (pi *PrivateInfoS) GetUserInfoByState(state string) (uis []*UserInfo) {
+	pi.DB.Order("id").Find(&uis, "state = ?", state)
+	return uis
+}
+
+// AcceptUserInfo - turn contact request into a contact and introduce
+// ourselves.
+func (pi *PrivateInfoS) AcceptUserInfo(ui *UserInfo) error {
+	if ui.ID == 0 {
+		return errors.New("user doesn't exist")
+	}
+	ui.State = UserInfoStateAccepted
+	pi.DB.Save(ui)
+	ui.SendIntroduceEvent(pi)
+	return nil
+}
+
+func (pi *PrivateInfoS) RejectUserInfo(ui *UserInfo) error {
+	return pi.setUserInfoState(ui, UserInfoStateRejected)
+}
+
+// BlockUserInfo - drop everything that the user sends us, events that
+// are still queued for them are deleted.
+func (pi *PrivateInfoS) BlockUserInfo(ui *UserInfo) error {
+	err := pi.setUserInfoState(ui, UserInfoStateBlocked)
+	if err != nil {
+		return err
+	}
+	pi.DB.Delete(&QueuedEvent{}, "key_id = ?", ui.GetKeyID())
+	return nil
+}
+
+func (pi *PrivateInfoS) setUserInfoState(ui *UserInfo, state string) error {
+	if ui.ID == 0 {
+		return errors.New("user doesn't exist")
+	}
+	log.Println("UserInfo", ui.ID, "state:", ui.State, "->", state)
+	ui.State = state
+	pi.DB.Save(ui)
+	return nil
+}
+
+// isDroppedSender - true if evt comes from a blocked contact, or is
+// anything but introduce from a rejected one.
+func (pi *PrivateInfoS) isDroppedSender(evt *Event) bool {
+	var ui *UserInfo
+	var err error
+	if evt.EventType == EventTypeIntroduce {
+		var publicKey *crypto.Key
+		publicKey, err = crypto.NewKeyFromArmored(evt.Data.EventDataIntroduce.PublicKey)
+		if err != nil {
+			return false
+		}
+		ui, err = pi.GetUserInfoByFingerprint(publicKey.GetFingerprint())
+	} else {
+		ui, err = pi.GetUserInfoByKeyID(evt.InternalKeyID)
+	}
+	if err != nil {
+		return false
+	}
+	switch ui.State {
+	case UserInfoStateBlocked:
+		return true
+	case UserInfoStateRejected:
+		return evt.EventType != EventTypeIntroduce
+	}
+	return false
+}
+
+// IntroductionRequest - pending contact, as seen by the introduction
+// request API. Requests used to have a table of their own, now they are
+// just UserInfo in UserInfoStatePending and ID is the UserInfo ID.
+type IntroductionRequest struct {
+	ID          uint
+	Username    string
+	PublicKey   string
+	Fingerprint string
+	KeyID       string
+	Endpoint    Endpoint
+}
+
+func introductionRequestOf(ui *UserInfo) *IntroductionRequest {
+	return &IntroductionRequest{
+		ID:          ui.ID,
+		Username:    ui.Username,
+		PublicKey:   ui.Publickey,
+		Fingerprint: ui.Fingerprint,
+		KeyID:       ui.GetKeyID(),
+		Endpoint:    ui.Endpoint,
+	}
+}
+
+// GetIntroductionRequests - same as GetUserInfoByState(UserInfoStatePending).
+func (pi *PrivateInfoS) GetIntroductionRequests() (irs []*IntroductionRequest) {
+	for _, ui := range pi.GetUserInfoByState(UserInfoStatePending) {
+		irs = append(irs, introductionRequestOf(ui))
+	}
+	return irs
+}
+
+// GetIntroductionRequestByID - empty request (ID 0) if there is no such
+// pending contact.
+func (pi *PrivateInfoS) GetIntroductionRequestByID(id uint) *IntroductionRequest {
+	ui, err := pi.GetUserInfoByID(id)
+	if err != nil || ui.State != UserInfoStatePending {
+		return &IntroductionRequest{}
+	}
+	return introductionRequestOf(ui)
+}
+
+// AcceptIntroductionRequest - AcceptUserInfo for the pending contact.
+func (pi *PrivateInfoS) AcceptIntroductionRequest(ir *IntroductionRequest) (*UserInfo, error) {
+	if ir.ID == 0 {
+		return nil, errors.New("introduction request doesn't exist")
+	}
+	ui, err := pi.GetUserInfoByID(ir.ID)
+	if err != nil {
+		return nil, err
+	}
+	return ui, pi.AcceptUserInfo(ui)
+}
+
+// DeleteIntroductionRequest - RejectUserInfo for the pending contact, they
+// can ask again only with a valid invite token.
+func (pi *PrivateInfoS) DeleteIntroductionRequest(ir *IntroductionRequest) {
+	if ir.ID == 0 {
+		return
+	}
+	ui, err := pi.GetUserInfoByID(ir.ID)
+	if err != nil {
+		return
+	}
+	err = pi.RejectUserInfo(ui)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// migrateIntroductionRequests - turn requests stored in the old
+// introduction_requests table into pending contacts.
+func (pi *PrivateInfoS) migrateIntroductionRequests() {
+	if !pi.DB.Migrator().HasTable("introduction_requests") {
+		return
+	}
+	var irs []struct {
+		PublicKey string
+		Endpoint  string
+	}
+	pi.DB.Table("introduction_requests").Where("deleted_at IS NULL").Find(&irs)
+	for _, ir := range irs {
+		publicKey, err := crypto.NewKeyFromArmored(ir.PublicKey)
+		if err != nil {
+			continue
+		}
+		_, err = pi.GetUserInfoByFingerprint(publicKey.GetFingerprint())
+		if err == nil {
+			continue
+		}
+		_, err = pi.saveUserByPublicKey(ir.PublicKey, "", Endpoint(ir.Endpoint), UserInfoStatePending)
+		if err != nil {
+			log.Println("Unable to migrate introduction request:", err)
+		}
+	}
+	log.Println("DB.DropTable.IntroductionRequest", pi.DB.Migrator().DropTable("introduction_requests"))
+}
@@ -0,0 +1,218 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/ProtonMail/gopenpgp/v2/helper"
+)
+
+// Trust model of discovery documents: a document is cleartext signed
+// by the key that it advertises. On it's own that only proves that
+// whoever served it holds that key - somebody in the middle can serve a
+// document for a key of their own just as well. So:
+//   - when we already know who should be behind the endpoint (contact
+//     that we have, fingerprint from an invite) the document has to be
+//     signed by that key, see DiscoverUserByURLPinned,
+//   - otherwise it is trust on first use, the fingerprint has to be
+//     compared out of band (invite links carry it for this reason).
+// Documents are signed on every request, so old ones are rejected as
+// replays (DiscoveryMaxAge). Servers that predate signing serve plain
+// JSON, such documents are accepted with Signed = false when nothing is
+// pinned, nothing in them can be trusted.
+
+// DiscoveryVersion - version of the discovery document that we serve.
+const DiscoveryVersion = 1
+
+// DiscoveryMaxClockSkew - documents signed further in the future than
+// that are rejected.
+var DiscoveryMaxClockSkew = time.Minute * 10
+
+// DiscoveryMaxAge - documents signed longer ago than that are rejected.
+var DiscoveryMaxAge = time.Hour
+
+const (
+	// DiscoveryModePublic - anyone can GET the discovery document.
+	DiscoveryModePublic = "public"
+	// DiscoveryModeContacts - only requests authenticated with a bearer
+	// that we gave to a contact (RemoteFilesAccessBearer).
+	DiscoveryModeContacts = "contacts"
+	// DiscoveryModeDisabled - nobody, the account is reachable only by
+	// people that already have it's key and endpoint.
+	DiscoveryModeDisabled = "disabled"
+)
+
+// SetDiscoveryMode - one of DiscoveryMode* constants.
+func (pi *PrivateInfoS) SetDiscoveryMode(mode string, hideProfile bool) error {
+	switch mode {
+	case DiscoveryModePublic, DiscoveryModeContacts, DiscoveryModeDisabled:
+	default:
+		return errors.New("unknown discovery mode: " + mode)
+	}
+	pi.DiscoveryMode = mode
+	pi.DiscoveryHideProfile = hideProfile
+	pi.DB.Save(pi)
+	return nil
+}
+
+// isDiscoveryAuthorized - true if auth is a bearer that we gave to one of
+// our contacts.
+func (pi *PrivateInfoS) isDiscoveryAuthorized(auth string) bool {
+	auth = strings.TrimPrefix(auth, "Bearer ")
+	if auth == "" {
+		return false
+	}
+	var count int64
+	pi.DB.Model(&SharedForBearer{}).Where("bearer = ?", auth).Count(&count)
+	return count != 0 || pi.findValidInviteToken(auth) != nil
+}
+
+// discoveryFor - discovery document for a request with given
+// Authentication header, false if it shouldn't be served at all.
+func (pi *PrivateInfoS) discoveryFor(auth string) (DiscoveredUserInfo, bool) {
+	authorized := pi.isDiscoveryAuthorized(auth)
+	switch pi.DiscoveryMode {
+	case DiscoveryModeDisabled:
+		return DiscoveredUserInfo{}, false
+	case DiscoveryModeContacts:
+		if !authorized {
+			return DiscoveredUserInfo{}, false
+		}
+	}
+	dui := pi.GetDiscoveredUserInfo()
+	if pi.DiscoveryHideProfile && !authorized {
+		dui.Name = ""
+		dui.Bio = ""
+		dui.AvatarHash = ""
+	}
+	return dui, true
+}
+
+// GetDiscoveryAuthentication - bearer that ui gave us, it lets us see
+// their discovery document when it isn't public.
+func (pi *PrivateInfoS) GetDiscoveryAuthentication(ui *UserInfo) string {
+	var sfm SharedFilesMetadata
+	pi.DB.First(&sfm, "db_key_id = ?", ui.GetKeyID())
+	return sfm.Authentication
+}
+
+// DiscoverUserInfo - fetch discovery document of a contact, authenticated
+// and pinned to the key that we know them by.
+func (pi *PrivateInfoS) DiscoverUserInfo(ui *UserInfo) (DiscoveredUserInfo, error) {
+	return DiscoverUserByURLPinned(ui.Endpoint.GetHost(), pi.GetDiscoveryAuthentication(ui), ui.Fingerprint)
+}
+
+// knownFingerprint - fingerprint of the contact behind endpoint, empty if
+// we don't have one.
+func (pi *PrivateInfoS) knownFingerprint(endpoint Endpoint) string {
+	var ui UserInfo
+	pi.DB.First(&ui, "endpoint = ?", endpoint)
+	return ui.Fingerprint
+}
+
+func (pi *PrivateInfoS) signDiscovery(dui DiscoveredUserInfo) ([]byte, error) {
+	dui.Timestamp = time.Now().Unix()
+	dui.Signed = false
+	privKey, err := crypto.NewKeyFromArmored(pi.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	dui.Fingerprint = strings.ToLower(privKey.GetFingerprint())
+	b, err := json.Marshal(dui)
+	if err != nil {
+		return nil, err
+	}
+	armored, err := helper.SignCleartextMessageArmored(pi.PrivateKey, pi.Passphrase, string(b))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(armored), nil
+}
+
+// verifyDiscovery - check that the document is signed by the key that it
+// advertises, and that it is consistent with itself. If pinned is not
+// empty the key has to have that fingerprint.
+func verifyDiscovery(body []byte, pinned string) (dui DiscoveredUserInfo, err error) {
+	msg, err := crypto.NewClearTextMessageFromArmored(string(body))
+	if err != nil {
+		return verifyLegacyDiscovery(body, pinned)
+	}
+	// We need the key before we can verify anything, so read it from the
+	// unverified document first.
+	var unverified DiscoveredUserInfo
+	err = json.Unmarshal(msg.GetBinary(), &unverified)
+	if err != nil {
+		return dui, err
+	}
+	text, err := helper.VerifyCleartextMessageArmored(unverified.PublicKey, string(body), crypto.GetUnixTime())
+	if err != nil {
+		return dui, err
+	}
+	err = json.Unmarshal([]byte(text), &dui)
+	if err != nil {
+		return DiscoveredUserInfo{}, err
+	}
+	dui.Signed = true
+	pubKey, err := crypto.NewKeyFromArmored(dui.PublicKey)
+	if err != nil {
+		return DiscoveredUserInfo{}, err
+	}
+	if !strings.EqualFold(pubKey.GetFingerprint(), dui.Fingerprint) {
+		return DiscoveredUserInfo{}, errors.New("discovery document fingerprint doesn't match publickey")
+	}
+	if pinned != "" && !strings.EqualFold(dui.Fingerprint, pinned) {
+		return DiscoveredUserInfo{}, errors.New("discovery document is signed by an unexpected key")
+	}
+	if dui.Version < 1 {
+		return DiscoveredUserInfo{}, errors.New("unsupported discovery document version")
+	}
+	if time.Unix(dui.Timestamp, 0).After(time.Now().Add(DiscoveryMaxClockSkew)) {
+		return DiscoveredUserInfo{}, errors.New("discovery document is from the future")
+	}
+	if time.Since(time.Unix(dui.Timestamp, 0)) > DiscoveryMaxAge {
+		return DiscoveredUserInfo{}, errors.New("discovery document is too old")
+	}
+	if dui.StampBits < 0 || dui.StampBits > StampMaxRemoteBits {
+		return DiscoveredUserInfo{}, errors.New("discovery document asks for unreasonable proof of work")
+	}
+	if dui.Endpoint != "" && len(dui.Endpoints) != 0 {
+		found := false
+		for i := range dui.Endpoints {
+			if string(dui.Endpoints[i]) == dui.Endpoint {
+				found = true
+			}
+		}
+		if !found {
+			return DiscoveredUserInfo{}, errors.New("discovery document endpoint is not listed in endpoints")
+		}
+	}
+	return dui, nil
+}
+
+// verifyLegacyDiscovery - unsigned {name, bio, publickey, endpoint}
+// document served by older versions. Refused if pinned is not empty.
+func verifyLegacyDiscovery(body []byte, pinned string) (dui DiscoveredUserInfo, err error) {
+	if pinned != "" {
+		return DiscoveredUserInfo{}, errors.New("discovery document is not signed")
+	}
+	err = json.Unmarshal(body, &dui)
+	if err != nil {
+		return DiscoveredUserInfo{}, errors.New("discovery document is neither signed nor legacy")
+	}
+	pubKey, err := crypto.NewKeyFromArmored(dui.PublicKey)
+	if err != nil {
+		return DiscoveredUserInfo{}, err
+	}
+	// Whatever the document says about itself means nothing.
+	dui = DiscoveredUserInfo{
+		Name:        dui.Name,
+		Bio:         dui.Bio,
+		PublicKey:   dui.PublicKey,
+		Endpoint:    dui.Endpoint,
+		Fingerprint: strings.ToLower(pubKey.GetFingerprint()),
+	}
+	return dui, nil
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// createTestAccount - created account that is not served anywhere.
+func createTestAccount(t *testing.T, name string) *PrivateInfoS {
+	t.Helper()
+	pi := OpenPrivateInfo(t.TempDir(), name, name, false)
+	if err := pi.Create(name, name+"@localhost", 1024); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ClosePrivateInfo(pi) })
+	return pi
+}
+
+func TestVerifyDiscovery(t *testing.T) {
+	alice := createTestAccount(t, "alice")
+	b, err := alice.signDiscovery(alice.GetDiscoveredUserInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), `"signed"`) {
+		t.Fatal("signed should not be part of the document")
+	}
+	dui, err := verifyDiscovery(b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dui.Signed || dui.Name != "alice" {
+		t.Fatal("unexpected document", dui)
+	}
+	_, err = verifyDiscovery(b, dui.Fingerprint)
+	if err != nil {
+		t.Fatal("pinned to the right key:", err)
+	}
+	j, err := json.Marshal(dui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(j), `"signed":true`) {
+		t.Fatal("signed should be exposed to the UI:", string(j))
+	}
+
+	bob := createTestAccount(t, "bob")
+	_, err = verifyDiscovery(b, strings.ToLower(bob.GetFingerprint()))
+	if err == nil {
+		t.Fatal("document pinned to another key was accepted")
+	}
+	tampered := strings.Replace(string(b), `"name":"alice"`, `"name":"mallory"`, 1)
+	_, err = verifyDiscovery([]byte(tampered), "")
+	if err == nil {
+		t.Fatal("tampered document was accepted")
+	}
+}
+
+func TestVerifyLegacyDiscovery(t *testing.T) {
+	alice := createTestAccount(t, "alice")
+	b, err := json.Marshal(map[string]string{
+		"name":      "alice",
+		"publickey": alice.PublicKey,
+		"endpoint":  "local://127.0.0.1:1/alice",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dui, err := verifyDiscovery(b, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dui.Signed || dui.Name != "alice" {
+		t.Fatal("unexpected document", dui)
+	}
+	_, err = verifyDiscovery(b, dui.Fingerprint)
+	if err == nil {
+		t.Fatal("unsigned document was accepted for a pinned key")
+	}
+}
+
+func TestDiscoveryModes(t *testing.T) {
+	alice := createTestAccount(t, "alice")
+	it, err := alice.CreateInviteToken(0, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SetDiscoveryMode("friends", false); err == nil {
+		t.Fatal("unknown discovery mode was accepted")
+	}
+	tests := []struct {
+		mode     string
+		hide     bool
+		auth     string
+		served   bool
+		withName bool
+	}{
+		{DiscoveryModePublic, false, "", true, true},
+		{DiscoveryModePublic, true, "", true, false},
+		{DiscoveryModePublic, true, "Bearer " + it.Token, true, true},
+		{DiscoveryModeContacts, false, "", false, false},
+		{DiscoveryModeContacts, false, "Bearer wrong", false, false},
+		{DiscoveryModeContacts, true, "Bearer " + it.Token, true, true},
+		{DiscoveryModeDisabled, false, "Bearer " + it.Token, false, false},
+	}
+	for _, tt := range tests {
+		if err := alice.SetDiscoveryMode(tt.mode, tt.hide); err != nil {
+			t.Fatal(err)
+		}
+		dui, ok := alice.discoveryFor(tt.auth)
+		if ok != tt.served {
+			t.Errorf("%s hide:%v auth:%q served %v", tt.mode, tt.hide, tt.auth, ok)
+		}
+		if ok && (dui.Name != "") != tt.withName {
+			t.Errorf("%s hide:%v auth:%q name %q", tt.mode, tt.hide, tt.auth, dui.Name)
+		}
+		if ok && dui.PublicKey == "" {
+			t.Errorf("%s hide:%v auth:%q without a key", tt.mode, tt.hide, tt.auth)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"encoding/json"
 	"log"
 	"net/url"
 )
@@ -21,7 +22,12 @@ func (e *Endpoint) GetHost() string {
 		return ""
 	}
 	// ${urip.host}:${urip.port}${urip.path}${urip.query}
-	host := "http://" + uri.Host + uri.Path + uri.RawQuery
+	// local:// keeps its scheme, i2pRoute decides how to reach it.
+	scheme := "http://"
+	if uri.Scheme == "local" {
+		scheme = "local://"
+	}
+	host := scheme + uri.Host + uri.Path + uri.RawQuery
 	return host
 }
 
@@ -42,6 +48,60 @@ func (e *Endpoint) GetExtra() string {
 	return uri.Fragment
 }
 
+// EndpointList - ordered list of endpoints, most preferred first.
+// Older clients send a single endpoint as a plain string, so this is
+// how it is encoded when there is only one of them, and both forms
+// are accepted when decoding.
+type EndpointList []Endpoint
+
+func (el EndpointList) MarshalJSON() ([]byte, error) {
+	if len(el) == 1 {
+		return json.Marshal(string(el[0]))
+	}
+	return json.Marshal([]Endpoint(el))
+}
+
+func (el *EndpointList) UnmarshalJSON(b []byte) error {
+	var single string
+	if json.Unmarshal(b, &single) == nil {
+		*el = mergeEndpoints([]Endpoint{Endpoint(single)})
+		return nil
+	}
+	var list []Endpoint
+	err := json.Unmarshal(b, &list)
+	if err != nil {
+		return err
+	}
+	*el = mergeEndpoints(list)
+	return nil
+}
+
+// mergeEndpoints - drop empty and duplicated endpoints, keeping the order.
+func mergeEndpoints(endpoints []Endpoint) (ret []Endpoint) {
+	seen := make(map[Endpoint]bool)
+	for _, e := range endpoints {
+		if e == "" || seen[e] {
+			continue
+		}
+		seen[e] = true
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+// WithPath - same endpoint, but pointing to given path on the same host.
+func (e *Endpoint) WithPath(p string) Endpoint {
+	uri, err := url.Parse(string(*e))
+	if err != nil {
+		log.Println("Unbale to Endpoint.WithPath:", err)
+		return ""
+	}
+	uri.Path = p
+	uri.RawQuery = ""
+	uri.Fragment = ""
+	return Endpoint(uri.String())
+}
+
 /// local or i2p or tor
 //String protocol;
 
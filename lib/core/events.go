@@ -1,9 +1,9 @@
 package core
 
 import (
+	"errors"
 	"gorm.io/gorm"
 	"log"
-	"strings"
 
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/google/uuid"
@@ -20,6 +20,9 @@ const (
 	EventTypeIntroduce        EventType = "introduce"
 	EventTypeIntroduceRequest EventType = "introduce.request"
 	EventTypeMessage          EventType = "message"
+	EventTypeMailboxOffer     EventType = "mailbox.offer"
+	EventTypeChunk            EventType = "chunk"
+	EventTypeFilesChanged     EventType = "files.changed"
 )
 
 type Event struct {
@@ -27,12 +30,16 @@ type Event struct {
 	EventType     EventType      `json:"type"`
 	Data          EventDataMixed `json:"data"`
 	Uuid          string         `json:"uuid"`
+	// Stamp - proof of work on introductions to strangers, see
+	// mintStamp.
+	Stamp string `json:"stamp,omitempty"`
 }
 
 type EventEncodable struct {
 	EventType EventType   `json:"type"`
 	Data      interface{} `json:"data"`
 	Uuid      string      `json:"uuid"`
+	Stamp     string      `json:"stamp,omitempty"`
 }
 
 func (evt *Event) RandomizeUuid() {
@@ -43,6 +50,9 @@ type EventDataMixed struct {
 	EventDataIntroduce
 	EventDataIntroduceRequest
 	EventDataMessage
+	EventDataMailboxOffer
+	EventDataChunk
+	EventDataFilesChanged
 }
 
 type MessageType string
@@ -56,14 +66,35 @@ const (
 
 type EventDataIntroduce struct {
 	PublicKey     string                          `json:"publickey,omitempty"`
-	Endpoint      Endpoint                        `json:"endpoints,omitempty"`
+	Endpoints     EndpointList                    `json:"endpoints,omitempty"`
 	Username      string                          `json:"username,omitempty"`
 	FilesMetadata map[string]*SharedFilesMetadata `json:"filesMetadata,omitempty"`
+	Mailboxes     []Endpoint                      `json:"mailboxes,omitempty"`
+	// PullDelivery - sender is unable to receive events, keep them
+	// and serve them from Outbox.
+	PullDelivery bool            `json:"pullDelivery,omitempty"`
+	Outbox       *OutboxMetadata `json:"outbox,omitempty"`
+	Capabilities []string        `json:"capabilities,omitempty"`
+	// InviteToken - token of the invite that the sender has accepted.
+	InviteToken string `json:"inviteToken,omitempty"`
+	// Recipient - fingerprint of the contact that the introduce is for.
+	Recipient string `json:"recipient,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	// Signed - all of the above, cleartext signed with PublicKey. Only
+	// the signed copy is trusted, see verifyIntroduce.
+	Signed string `json:"signed,omitempty"`
+}
+
+// OutboxMetadata - where to poll for events that sender is keeping
+// for us.
+type OutboxMetadata struct {
+	Endpoint       Endpoint `json:"endpoint,omitempty"`
+	Authentication string   `json:"authentication,omitempty"`
 }
 
 type SharedFilesMetadata struct {
 	gorm.Model     `json:"-"`
-	DBKeyID        string   `json:"-",gorm:"column:db_key_id"`
+	DBKeyID        string   `json:"-" gorm:"column:db_key_id"`
 	KeyPart        string   `json:"keyPart,omitempty"`
 	FilesEndpoint  Endpoint `json:"filesEndpoint,omitempty"`
 	Authentication string   `json:"authentication,omitempty"`
@@ -71,44 +102,149 @@ type SharedFilesMetadata struct {
 
 type EventDataIntroduceRequest struct {
 	SelfPublicKey string   `json:"selfpublickey,omitempty"`
+	SelfUsername  string   `json:"selfusername,omitempty"`
 	Endpoint      Endpoint `json:"endpoint,omitempty"`
+	// Token - invite token, without a valid one the request is held as
+	// pending contact.
+	Token string `json:"token,omitempty"`
 }
 type EventDataMessage struct {
 	Text    string      `json:"text,omitempty"`
 	MsgUUID string      `json:"msguuid,omitempty"`
 	Type    MessageType `json:"type,omitempty"`
 }
+type EventDataChunk struct {
+	ChunkSet     string `json:"chunkSet,omitempty"`
+	ChunkIndex   int    `json:"chunkIndex,omitempty"`
+	ChunkTotal   int    `json:"chunkTotal,omitempty"`
+	ChunkPayload []byte `json:"chunkPayload,omitempty"`
+}
+type EventDataMailboxOffer struct {
+	MailboxEndpoint       Endpoint `json:"mailboxEndpoint,omitempty"`
+	MailboxAuthentication string   `json:"mailboxAuthentication,omitempty"`
+}
 
-func (evt *Event) TryProcess(pi *PrivateInfoS) {
+// TryProcess - process incoming event, returned error means that the
+// event wasn't processed and sender should retry it later.
+// Events that were already processed (see ProcessedEvent) are skipped.
+func (evt *Event) TryProcess(pi *PrivateInfoS) error {
+	if pi.isEventProcessed(evt.Uuid) {
+		log.Println("Skipping already processed event:", evt.Uuid)
+		return nil
+	}
+	pi.metricsInboundEvent(evt.EventType)
+	if !pi.checkStamp(evt) {
+		return nil
+	}
+	if pi.isDroppedSender(evt) {
+		log.Println("Dropping", evt.EventType, "event from blocked sender.")
+		pi.markEventProcessed(evt.Uuid)
+		return nil
+	}
 	for i := range pi.EventCallback {
 		pi.EventCallback[i](pi, evt)
 	}
+	var err error
 	switch evt.EventType {
 	case EventTypeIntroduce:
-		evt.tryProcessIntroduce(pi)
+		err = evt.tryProcessIntroduce(pi)
 	case EventTypeIntroduceRequest:
-		evt.tryProcessIntroduceRequest(pi)
+		err = evt.tryProcessIntroduceRequest(pi)
 	case EventTypeMessage:
-		evt.tryProcessMessage(pi)
+		err = evt.tryProcessMessage(pi)
+	case EventTypeMailboxOffer:
+		err = evt.tryProcessMailboxOffer(pi)
+	case EventTypeChunk:
+		err = evt.tryProcessChunk(pi)
+	case EventTypeFilesChanged:
+		err = evt.tryProcessFilesChanged(pi)
 	default:
 		log.Println("WARN: Unhandled event, type:", evt.EventType)
 	}
+	if err != nil {
+		return err
+	}
+	pi.markEventProcessed(evt.Uuid)
+	return nil
 }
 
 // EventTypeUnimplemented    EventType = "unimplemented"
 // EventTypeIntroduce        EventType = "introduce"
-func (evt *Event) tryProcessIntroduce(pi *PrivateInfoS) {
+func (evt *Event) tryProcessIntroduce(pi *PrivateInfoS) error {
 	log.Println("evt.tryProcessIntroduce")
 	if evt.EventType != EventTypeIntroduce {
 		log.Fatalln("invalid type.")
 	}
-	ui, err := pi.CreateUserByPublicKey(
-		evt.Data.EventDataIntroduce.PublicKey,
-		evt.Data.EventDataIntroduce.Username,
-		evt.Data.EventDataIntroduce.Endpoint,
-		false,
-	)
-	log.Println("new introduction:", evt.Data.EventDataIntroduce.Username, ui.Username, err)
+	intro, err := pi.verifyIntroduce(evt.Data.EventDataIntroduce)
+	signed := err == nil
+	if err == errIntroduceNotSigned {
+		// Legacy client, nothing in there can be trusted.
+		intro = evt.Data.EventDataIntroduce
+		intro.InviteToken = ""
+		intro.Timestamp = 0
+	} else if err != nil {
+		log.Println("WARN: Dropping introduce:", err)
+		return nil
+	}
+	evt.Data.EventDataIntroduce = intro
+	endpoints := intro.Endpoints
+	var primary Endpoint
+	if len(endpoints) != 0 {
+		primary = endpoints[0]
+	}
+	publicKey, err := crypto.NewKeyFromArmored(intro.PublicKey)
+	if err != nil {
+		log.Println("WARN: Unable to armor public key, returning.", err)
+		return nil
+	}
+	keyid := StringToKeyID(publicKey.GetHexKeyID())
+	ui, err := pi.GetUserInfoByFingerprint(publicKey.GetFingerprint())
+	if err != nil {
+		// Stranger, unless they have our invite it is only a request.
+		state := UserInfoStatePending
+		if pi.useInviteToken(intro.InviteToken, keyid, primary) {
+			state = UserInfoStateAccepted
+		}
+		ui, err = pi.saveUserByPublicKey(intro.PublicKey, intro.Username, primary, state)
+		log.Println("new introduction:", intro.Username, state, err)
+		if err != nil {
+			return err
+		}
+		if len(endpoints) != 0 {
+			ui.SetEndpoints(endpoints)
+		}
+	} else {
+		if !signed {
+			log.Println("Ignoring unsigned introduce for existing contact:", ui.ID)
+			return nil
+		}
+		if intro.Timestamp <= ui.IntroducedAt {
+			log.Println("Ignoring introduce older than the last one from:", ui.ID)
+			return nil
+		}
+		if !pi.acceptByInvite(ui, intro.InviteToken, keyid, primary) && ui.State == UserInfoStateRejected {
+			log.Println("Ignoring introduce from rejected contact:", ui.ID)
+			return nil
+		}
+		// Name is ours to choose, but the introduce is signed by the key
+		// that we know them by, so they are free to move.
+		if len(endpoints) != 0 {
+			ui.SetEndpoints(endpoints)
+		}
+	}
+	ui.IntroducedAt = intro.Timestamp
+	ui.Mailboxes = intro.Mailboxes
+	ui.PullDelivery = intro.PullDelivery
+	ui.Capabilities = intro.Capabilities
+	// They know about us now, no need to present the invite anymore.
+	ui.InviteToken = ""
+	pi.DB.Save(ui)
+	if !ui.PullDelivery {
+		// They are reachable again, relay whatever is still waiting.
+		pi.DB.Model(&QueuedEvent{}).Where("pull = ? AND key_id = ?", true, ui.GetKeyID()).
+			Updates(map[string]interface{}{"pull": false, "endpoint": ui.Endpoint})
+	}
+	pi.setOutbox(ui, evt.Data.EventDataIntroduce.Outbox)
 
 	fs := evt.Data.EventDataIntroduce.FilesMetadata
 	pi.DB.Where("db_key_id = ?", ui.GetKeyID()).Delete(&SharedFilesMetadata{})
@@ -121,53 +257,87 @@ func (evt *Event) tryProcessIntroduce(pi *PrivateInfoS) {
 		})
 	}
 
+	pi.publish(NotificationIntroduce, NotificationIntroduceData{
+		UserInfoID: ui.ID,
+		KeyID:      ui.GetKeyID(),
+		Username:   ui.Username,
+		State:      ui.State,
+	})
 	for i := range pi.IntroduceCallback {
 		pi.IntroduceCallback[i](pi, ui, evt)
 	}
+	return nil
 }
 
 // EventTypeIntroduceRequest EventType = "introduce.request"
-func (evt *Event) tryProcessIntroduceRequest(pi *PrivateInfoS) {
+func (evt *Event) tryProcessIntroduceRequest(pi *PrivateInfoS) error {
 	log.Println("evt.tryProcessIntroduceRequest")
 	if evt.EventType != EventTypeIntroduceRequest {
 		log.Fatalln("invalid type.")
 	}
-	publicKey, err := crypto.NewKeyFromArmored(evt.Data.PublicKey)
+	req := evt.Data.EventDataIntroduceRequest
+	publicKey, err := crypto.NewKeyFromArmored(req.SelfPublicKey)
 	if err != nil {
-		log.Println("WARN: Unable to armor public key, returning.", err)
-		return
+		log.Println("WARN: Unable to armor public key, ignoring.", err)
+		return nil
+	}
+	keyid := StringToKeyID(publicKey.GetHexKeyID())
+	// Signature was checked while decrypting, make sure that it was made
+	// by the key that we are asked to add.
+	if StringToKeyID(evt.InternalKeyID) != keyid {
+		log.Println("WARN: introduce.request is not signed by the key it carries, ignoring.")
+		return nil
+	}
+	if req.Endpoint == "" {
+		log.Println("WARN: introduce.request without endpoint, ignoring.")
+		return nil
 	}
-	var ui *UserInfo
-	pi.DB.Where("fingerprint = ?", publicKey.GetFingerprint()).First(ui)
-	b, err := publicKey.GetArmoredPublicKeyWithCustomHeaders("p3pgo", "")
+	ui, err := pi.GetUserInfoByFingerprint(publicKey.GetFingerprint())
 	if err != nil {
-		log.Println("WARN: Unable to publickey.GetPublicKey()")
-		return
-	}
-	ui.Publickey = b
-	ui.Fingerprint = strings.ToLower(publicKey.GetFingerprint())
-	ui.Endpoint = evt.Data.EventDataIntroduceRequest.Endpoint
-	pi.DB.Save(&ui)
-	QueueEvent(pi, Event{
-		EventType: EventTypeIntroduce,
-		Data: EventDataMixed{
-			EventDataIntroduce: EventDataIntroduce{
-				PublicKey: pi.PublicKey,
-				Endpoint:  pi.Endpoint,
-				Username:  pi.Username,
-			},
-		},
-	},
-		ui)
+		state := UserInfoStateAccepted
+		if !pi.useInviteToken(req.Token, keyid, req.Endpoint) {
+			log.Println("introduce.request without valid invite token, holding it.")
+			state = UserInfoStatePending
+		}
+		ui, err = pi.saveUserByPublicKey(req.SelfPublicKey, req.SelfUsername, req.Endpoint, state)
+		if err != nil {
+			return err
+		}
+		pi.publish(NotificationIntroduce, NotificationIntroduceData{
+			UserInfoID: ui.ID,
+			KeyID:      ui.GetKeyID(),
+			Username:   ui.Username,
+			State:      ui.State,
+		})
+	} else {
+		if ui.Endpoint == "" {
+			ui.SetEndpoints([]Endpoint{req.Endpoint})
+		}
+		if pi.acceptByInvite(ui, req.Token, keyid, req.Endpoint) {
+			log.Println("introduce.request with invite token, accepting:", ui.ID)
+			pi.publish(NotificationIntroduce, NotificationIntroduceData{
+				UserInfoID: ui.ID,
+				KeyID:      ui.GetKeyID(),
+				Username:   ui.Username,
+				State:      ui.State,
+			})
+		}
+		pi.DB.Save(ui)
+	}
+	if ui.State != UserInfoStateAccepted {
+		return nil
+	}
+	ui.SendIntroduceEvent(pi)
+	return nil
 }
 
 // EventTypeMessage          EventType = "message"
-func (evt *Event) tryProcessMessage(pi *PrivateInfoS) {
+func (evt *Event) tryProcessMessage(pi *PrivateInfoS) error {
 	log.Println("evt.tryProcessMessage")
 	if evt.InternalKeyID == "" {
 		log.Println("warn! unknown evt.InternalKeyID")
 		evt.InternalKeyID = "___UNKNOWN___"
-		return
+		return errors.New("message from unknown sender")
 	}
 	if len(evt.InternalKeyID) > 16 {
 		evt.InternalKeyID = evt.InternalKeyID[len(evt.InternalKeyID)-16:]
@@ -186,10 +356,46 @@ func (evt *Event) tryProcessMessage(pi *PrivateInfoS) {
 	}
 	ui, err := pi.GetUserInfoByKeyID(evt.InternalKeyID)
 	if err != nil {
+		// Message is already stored, there is no point in getting it again.
 		log.Println(err)
-		return
+		return nil
 	}
+	if ui.State != UserInfoStateAccepted {
+		// Message request, it is there once the user accepts them.
+		log.Println("Message from", ui.State, "contact, not notifying.")
+		return nil
+	}
+	pi.publish(NotificationMessage, NotificationMessageData{
+		UserInfoID: ui.ID,
+		KeyID:      evt.InternalKeyID,
+		MessageID:  msg.ID,
+		Incoming:   true,
+		Text:       msg.Body,
+	})
 	for i := range pi.MessageCallback {
 		pi.MessageCallback[i](pi, ui, evt, msg)
 	}
+	return nil
+}
+
+// EventTypeMailboxOffer     EventType = "mailbox.offer"
+func (evt *Event) tryProcessMailboxOffer(pi *PrivateInfoS) error {
+	log.Println("evt.tryProcessMailboxOffer")
+	ui, err := pi.GetUserInfoByKeyID(evt.InternalKeyID)
+	if err != nil {
+		log.Println("WARN: mailbox.offer from unknown contact, ignoring.", err)
+		return err
+	}
+	offer := evt.Data.EventDataMailboxOffer
+	if offer.MailboxEndpoint == "" || offer.MailboxAuthentication == "" {
+		log.Println("WARN: mailbox.offer without endpoint or authentication, ignoring.")
+		return nil
+	}
+	pi.DB.Delete(&Mailbox{}, "db_key_id = ? AND outbox = ?", ui.GetKeyID(), false)
+	pi.AddMailbox(ui.GetKeyID(), offer.MailboxEndpoint, offer.MailboxAuthentication)
+	// Let everybody know that we have a new way to be reached.
+	for _, contact := range pi.GetAllUserInfo() {
+		contact.SendIntroduceEvent(pi)
+	}
+	return nil
 }
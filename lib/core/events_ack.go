@@ -0,0 +1,183 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/ProtonMail/gopenpgp/v2/helper"
+	"gorm.io/gorm"
+)
+
+// DeliveryAck - HTTP 200 only tells us that something has answered, so
+// receiver responds to POST with DeliveryAck, cleartext signed with its
+// key, listing bodies that were journaled (and events that were
+// processed). Sender removes QueuedEvent only once it is acknowledged.
+type DeliveryAck struct {
+	Uuids []string `json:"uuids"`
+	// Bodies - sha256 of bodies that were stored in the inbound journal,
+	// their events are processed in the background.
+	Bodies []string `json:"bodies,omitempty"`
+	// Outbox - OutboxMetadata encrypted for the sender, if they want
+	// PullDelivery. Our introduce tells them where our outbox.http is,
+	// but it waits in that very outbox, see outboxFor.
+	Outbox string `json:"outbox,omitempty"`
+	// KeyMismatch - body was encrypted for a key that we don't have,
+	// only informational - sender has no other key to encrypt it for.
+	KeyMismatch bool `json:"keyMismatch,omitempty"`
+	// Fingerprint - key that receiver is currently using.
+	Fingerprint string `json:"fingerprint"`
+	Timestamp   int64  `json:"timestamp"`
+}
+
+// ProcessedEvent - Uuid of an event that we have already processed,
+// retried events (for example when DeliveryAck got lost) are skipped.
+type ProcessedEvent struct {
+	gorm.Model
+	Uuid string `gorm:"index"`
+}
+
+// ProcessedEventRetention - how long do we remember ProcessedEvent.
+var ProcessedEventRetention = time.Hour * 24 * 7
+
+func (pi *PrivateInfoS) isEventProcessed(uuid string) bool {
+	if uuid == "" {
+		return false
+	}
+	var count int64
+	pi.DB.Model(&ProcessedEvent{}).Where("uuid = ?", uuid).Count(&count)
+	return count != 0
+}
+
+func (pi *PrivateInfoS) markEventProcessed(uuid string) {
+	if uuid == "" {
+		return
+	}
+	pi.DB.Delete(&ProcessedEvent{}, "created_at < ?", time.Now().Add(-ProcessedEventRetention))
+	pi.DB.Save(&ProcessedEvent{Uuid: uuid})
+}
+
+func (ack *DeliveryAck) Contains(uuid string) bool {
+	for i := range ack.Uuids {
+		if ack.Uuids[i] == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+func (ack *DeliveryAck) ContainsBody(body []byte) bool {
+	sum := sha256Hex(body)
+	for i := range ack.Bodies {
+		if ack.Bodies[i] == sum {
+			return true
+		}
+	}
+	return false
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (pi *PrivateInfoS) signDeliveryAck(ack DeliveryAck) ([]byte, error) {
+	ack.Timestamp = time.Now().Unix()
+	privKey, err := crypto.NewKeyFromArmored(pi.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	ack.Fingerprint = strings.ToLower(privKey.GetFingerprint())
+	b, err := json.Marshal(ack)
+	if err != nil {
+		return nil, err
+	}
+	armored, err := helper.SignCleartextMessageArmored(pi.PrivateKey, pi.Passphrase, string(b))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(armored), nil
+}
+
+func verifyDeliveryAck(publicKey string, body []byte) (*DeliveryAck, error) {
+	if len(body) == 0 {
+		return nil, errors.New("empty delivery ack")
+	}
+	text, err := helper.VerifyCleartextMessageArmored(publicKey, string(body), crypto.GetUnixTime())
+	if err != nil {
+		return nil, err
+	}
+	var ack DeliveryAck
+	err = json.Unmarshal([]byte(text), &ack)
+	if err != nil {
+		return nil, err
+	}
+	return &ack, nil
+}
+
+// isEncryptedForUs - false if armored message is encrypted only for keys
+// that we don't have. This only looks at the message header, so it is
+// cheap enough to be done before decrypting the body.
+func (pi *PrivateInfoS) isEncryptedForUs(armored string) bool {
+	ciphertext, err := crypto.NewPGPMessageFromArmored(armored)
+	if err != nil {
+		return true // not a message at all, so this is not a key issue.
+	}
+	keyIDs, ok := ciphertext.GetEncryptionKeyIDs()
+	if !ok {
+		return true
+	}
+	key, err := crypto.NewKeyFromArmored(pi.PublicKey)
+	if err != nil {
+		log.Println("Unable to parse our own public key:", err)
+		return true
+	}
+	entity := key.GetEntity()
+	ours := map[uint64]bool{entity.PrimaryKey.KeyId: true}
+	for _, subkey := range entity.Subkeys {
+		ours[subkey.PublicKey.KeyId] = true
+	}
+	for _, keyID := range keyIDs {
+		// 0 - anonymous recipient, we can't tell.
+		if keyID == 0 || ours[keyID] {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDeliveryAck - decide if evt was delivered based on the response
+// body we got from endpoint.
+func (evt *QueuedEvent) checkDeliveryAck(pi *PrivateInfoS, endpoint Endpoint, body []byte) error {
+	if strings.Contains(string(endpoint), "/mailbox.http/") {
+		// Mailbox is not able to decrypt the event, best that we can get
+		// is it accepting the event.
+		return nil
+	}
+	ui, err := pi.GetUserInfoByKeyID(evt.KeyID)
+	if err != nil {
+		return nil
+	}
+	ack, err := verifyDeliveryAck(ui.Publickey, body)
+	if err == nil && ack.Outbox != "" {
+		// Before the capability check, we may not have their introduce
+		// yet if it waits in their outbox.
+		pi.saveAckOutbox(ui, ack.Outbox)
+	}
+	if !ui.HasCapability(CapabilityAck) {
+		// Peer that doesn't know about acks, HTTP 200 is all we get.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if ack.Contains(evt.Uuid) || ack.ContainsBody(evt.Body) {
+		return nil
+	}
+	return errors.New("event was not acknowledged")
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeliveryAck(t *testing.T) {
+	alice := createTestAccount(t, "alice")
+	body := []byte("journaled body")
+	b, err := alice.signDeliveryAck(DeliveryAck{
+		Uuids:  []string{"processed"},
+		Bodies: []string{sha256Hex(body)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, err := verifyDeliveryAck(alice.PublicKey, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ack.Contains("processed") || ack.Contains("other") {
+		t.Fatal("unexpected uuids", ack.Uuids)
+	}
+	if !ack.ContainsBody(body) || ack.ContainsBody([]byte("other body")) {
+		t.Fatal("unexpected bodies", ack.Bodies)
+	}
+	if !strings.EqualFold(ack.Fingerprint, alice.GetFingerprint()) {
+		t.Fatal("unexpected fingerprint", ack.Fingerprint)
+	}
+}
+
+func TestDeliveryAckRejected(t *testing.T) {
+	alice := createTestAccount(t, "alice")
+	bob := createTestAccount(t, "bob")
+	b, err := alice.signDeliveryAck(DeliveryAck{Uuids: []string{"processed"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = verifyDeliveryAck(bob.PublicKey, b)
+	if err == nil {
+		t.Fatal("ack signed by another key was accepted")
+	}
+	tampered := strings.Replace(string(b), "processed", "forged", 1)
+	_, err = verifyDeliveryAck(alice.PublicKey, []byte(tampered))
+	if err == nil {
+		t.Fatal("tampered ack was accepted")
+	}
+	_, err = verifyDeliveryAck(alice.PublicKey, nil)
+	if err == nil {
+		t.Fatal("empty ack was accepted")
+	}
+}
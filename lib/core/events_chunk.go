@@ -0,0 +1,183 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Events bigger than ChunkThreshold are not sent in one piece, instead
+// the event JSON is split into numbered chunk events, each one of them
+// encrypted and queued (and so retried) on it's own. Receiver collects
+// them in InboundChunk and processes the event once all of them are
+// there. Used only if the recipient advertises CapabilityChunk.
+
+// ChunkThreshold - events bigger than that are split into chunks.
+var ChunkThreshold = 256 * 1024
+
+// ChunkMaxCount - we refuse to collect sets bigger than that.
+var ChunkMaxCount = 4096
+
+// ChunkMaxSize - we refuse to collect sets bigger than that many bytes,
+// the set is dropped as soon as it gets over. QueueEvent refuses such
+// events on the sending side.
+var ChunkMaxSize int64 = 64 * 1024 * 1024
+
+// ChunkTimeout - incomplete sets older than that are dropped.
+var ChunkTimeout = time.Hour * 48
+
+// InboundChunk - chunk that we have received, waiting for the rest of
+// it's set.
+type InboundChunk struct {
+	gorm.Model
+	KeyID      string
+	ChunkSet   string `gorm:"index"`
+	ChunkIndex int
+	ChunkTotal int
+	Payload    []byte
+}
+
+// keyedLocks - mutex per key, entries go away once nobody holds or waits
+// for them.
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock - lock key, returned func unlocks it.
+func (kl *keyedLocks) lock(key string) func() {
+	kl.mu.Lock()
+	if kl.locks == nil {
+		kl.locks = make(map[string]*keyedLock)
+	}
+	l, ok := kl.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		kl.locks[key] = l
+	}
+	l.users++
+	kl.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		kl.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(kl.locks, key)
+		}
+		kl.mu.Unlock()
+	}
+}
+
+// queueChunks - split eventBody into chunk events and queue them.
+func queueChunks(pi *PrivateInfoS, eventBody []byte, ui *UserInfo) error {
+	set := Event{}
+	set.RandomizeUuid()
+	total := (len(eventBody) + ChunkThreshold - 1) / ChunkThreshold
+	log.Println("Splitting event into", total, "chunks, set:", set.Uuid)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * ChunkThreshold
+		if end > len(eventBody) {
+			end = len(eventBody)
+		}
+		err := QueueEvent(pi, Event{
+			EventType: EventTypeChunk,
+			Data: EventDataMixed{
+				EventDataChunk: EventDataChunk{
+					ChunkSet:     set.Uuid,
+					ChunkIndex:   i,
+					ChunkTotal:   total,
+					ChunkPayload: eventBody[i*ChunkThreshold : end],
+				},
+			},
+		}, ui)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EventTypeChunk            EventType = "chunk"
+func (evt *Event) tryProcessChunk(pi *PrivateInfoS) error {
+	log.Println("evt.tryProcessChunk")
+	pi.DB.Unscoped().Delete(&InboundChunk{}, "created_at < ?", time.Now().Add(-ChunkTimeout))
+	if evt.InternalKeyID == "" {
+		return errors.New("chunk from unknown sender")
+	}
+	c := evt.Data.EventDataChunk
+	if c.ChunkSet == "" || c.ChunkTotal <= 0 || c.ChunkTotal > ChunkMaxCount ||
+		c.ChunkIndex < 0 || c.ChunkIndex >= c.ChunkTotal {
+		log.Println("WARN: invalid chunk, ignoring.", c.ChunkSet, c.ChunkIndex, c.ChunkTotal)
+		return nil
+	}
+	keyid := StringToKeyID(evt.InternalKeyID)
+	// Chunks of the same set may be processed at once (inbound POST and
+	// InboundRunner, or the sender relaying two of them in parallel).
+	unlock := pi.chunkLocks.lock(keyid + "/" + c.ChunkSet)
+	defer unlock()
+	// Payloads stay in the database until the set is complete.
+	var have []struct {
+		ChunkIndex int
+		ChunkTotal int
+		Size       int64
+	}
+	pi.DB.Model(&InboundChunk{}).Select("chunk_index, chunk_total, length(payload) AS size").
+		Where("key_id = ? AND chunk_set = ?", keyid, c.ChunkSet).Scan(&have)
+	count := len(have)
+	size := int64(len(c.ChunkPayload))
+	found := false
+	for i := range have {
+		if have[i].ChunkTotal != c.ChunkTotal {
+			log.Println("WARN: chunk total doesn't match the set, ignoring.", c.ChunkSet)
+			return nil
+		}
+		if have[i].ChunkIndex == c.ChunkIndex {
+			found = true
+		}
+		size += have[i].Size
+	}
+	if !found {
+		if size > ChunkMaxSize {
+			log.Println("WARN: chunk set is too big, dropping it.", c.ChunkSet, size)
+			pi.DB.Unscoped().Delete(&InboundChunk{}, "key_id = ? AND chunk_set = ?", keyid, c.ChunkSet)
+			return nil
+		}
+		pi.DB.Save(&InboundChunk{
+			KeyID:      keyid,
+			ChunkSet:   c.ChunkSet,
+			ChunkIndex: c.ChunkIndex,
+			ChunkTotal: c.ChunkTotal,
+			Payload:    c.ChunkPayload,
+		})
+		count++
+	}
+	if count != c.ChunkTotal {
+		return nil
+	}
+	var chunks []InboundChunk
+	pi.DB.Order("chunk_index ASC").Find(&chunks, "key_id = ? AND chunk_set = ?", keyid, c.ChunkSet)
+	var body []byte
+	for i := range chunks {
+		body = append(body, chunks[i].Payload...)
+	}
+	log.Println("Chunk set complete:", c.ChunkSet, len(body), "bytes")
+	for _, inner := range processString(pi, string(body), evt.InternalKeyID) {
+		err := inner.TryProcess(pi)
+		if err != nil {
+			// Keep the chunks, so the set is processed again when the
+			// sender retries this chunk.
+			return err
+		}
+	}
+	pi.DB.Unscoped().Delete(&InboundChunk{}, "key_id = ? AND chunk_set = ?", keyid, c.ChunkSet)
+	return nil
+}
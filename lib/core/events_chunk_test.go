@@ -0,0 +1,85 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+// introduceTestContacts - alice and bob, contacts of each other that know
+// each other's capabilities. Returned ui is alice as seen by bob.
+func introduceTestContacts(t *testing.T, alice, bob *PrivateInfoS) *UserInfo {
+	t.Helper()
+	it, err := alice.CreateInviteToken(1, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ui, err := bob.RequestIntroduction(alice.Endpoint, it.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "introduce reply", func() bool {
+		ui, err = bob.GetUserInfoByID(ui.ID)
+		return err == nil && len(ui.Capabilities) != 0
+	})
+	return ui
+}
+
+func TestChunkedMessage(t *testing.T) {
+	ls := startTestServer(t)
+	alice := openTestAccount(t, ls, "alice")
+	bob := openTestAccount(t, ls, "bob")
+	ui := introduceTestContacts(t, alice, bob)
+	if !ui.HasCapability(CapabilityChunk) {
+		t.Fatal("alice should advertise", CapabilityChunk)
+	}
+
+	defer func(threshold int) { ChunkThreshold = threshold }(ChunkThreshold)
+	ChunkThreshold = 1024
+	text := strings.Repeat("0123456789", 500)
+	if err := bob.SendMessage(ui, MessageTypeText, text); err != nil {
+		t.Fatal(err)
+	}
+	var chunks int64
+	bob.DB.Unscoped().Model(&QueuedEvent{}).Where("event_type = ?", EventTypeChunk).Count(&chunks)
+	if chunks < 5 {
+		t.Fatal("message should be split into chunks, got", chunks)
+	}
+
+	waitFor(t, "alice to receive the message", func() bool {
+		bobUi, err := alice.GetUserInfoByKeyID(bob.GetKeyID())
+		if err != nil {
+			return false
+		}
+		msgs := alice.GetMessagesByUserInfo(bobUi)
+		return len(msgs) == 1 && msgs[0].Body == text
+	})
+	var left int64
+	alice.DB.Model(&InboundChunk{}).Count(&left)
+	if left != 0 {
+		t.Fatal("chunks of a complete set should be deleted, got", left)
+	}
+}
+
+func TestQueueEventTooBig(t *testing.T) {
+	ls := startTestServer(t)
+	alice := openTestAccount(t, ls, "alice")
+	bob := openTestAccount(t, ls, "bob")
+	ui := introduceTestContacts(t, alice, bob)
+
+	defer func(size int64) { ChunkMaxSize = size }(ChunkMaxSize)
+	ChunkMaxSize = 4096
+	var queued int64
+	bob.DB.Unscoped().Model(&QueuedEvent{}).Count(&queued)
+	err := bob.SendMessage(ui, MessageTypeText, strings.Repeat("x", 8192))
+	if err != ErrEventTooBig {
+		t.Fatal("expected ErrEventTooBig, got", err)
+	}
+	var after int64
+	bob.DB.Unscoped().Model(&QueuedEvent{}).Count(&after)
+	if after != queued {
+		t.Fatal("nothing should be queued,", after-queued, "events were")
+	}
+	if len(bob.GetMessagesByUserInfo(ui)) != 0 {
+		t.Fatal("message that can't be sent should not be stored")
+	}
+}
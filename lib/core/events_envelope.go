@@ -0,0 +1,113 @@
+package core
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+)
+
+// Envelope - what gets encrypted instead of the raw event JSON when the
+// recipient advertises CapabilityEnvelope. Event is compressed (if they
+// support CapabilityDeflate) and padded to one of envelopeBuckets, so
+// that the size of ciphertext tells as little as possible about the size
+// of the message.
+type Envelope struct {
+	// Compression - "deflate" or "none", also used to tell an envelope
+	// apart from a plain event.
+	Compression string `json:"p3penvelope"`
+	Payload     []byte `json:"payload"`
+	Padding     string `json:"padding,omitempty"`
+}
+
+const (
+	EnvelopeCompressionNone    = "none"
+	EnvelopeCompressionDeflate = "deflate"
+)
+
+// EnvelopeMaxSize - we refuse to decompress anything bigger than that.
+var EnvelopeMaxSize int64 = 64 * 1024 * 1024
+
+// envelopeBuckets - sizes that envelopes are padded to, anything bigger
+// than the last bucket is padded to a multiple of it.
+var envelopeBuckets = []int{1024, 2048, 4096, 8192, 16384, 32768, 65536}
+
+func envelopeBucket(size int) int {
+	for _, bucket := range envelopeBuckets {
+		if size <= bucket {
+			return bucket
+		}
+	}
+	last := envelopeBuckets[len(envelopeBuckets)-1]
+	return (size + last - 1) / last * last
+}
+
+// sealEnvelope - wrap eventBody in an Envelope if ui is able to open it,
+// otherwise eventBody is returned as is.
+func sealEnvelope(ui *UserInfo, eventBody []byte) []byte {
+	if !ui.HasCapability(CapabilityEnvelope) {
+		return eventBody
+	}
+	env := Envelope{Compression: EnvelopeCompressionNone, Payload: eventBody}
+	if ui.HasCapability(CapabilityDeflate) {
+		var buf bytes.Buffer
+		fw, err := flate.NewWriter(&buf, flate.BestCompression)
+		if err == nil {
+			_, err = fw.Write(eventBody)
+		}
+		if err == nil {
+			err = fw.Close()
+		}
+		if err != nil {
+			log.Println("Unable to deflate event:", err)
+		} else if buf.Len() < len(eventBody) {
+			env.Compression = EnvelopeCompressionDeflate
+			env.Payload = buf.Bytes()
+		}
+	}
+	b, err := json.Marshal(env)
+	if err != nil {
+		log.Println("Unable to json.Marshal envelope:", err)
+		return eventBody
+	}
+	// Padding is URL-safe, so every character of it adds exactly one byte.
+	padding, err := GenerateRandomString(envelopeBucket(len(b)+len(`,"padding":""`)) - len(b) - len(`,"padding":""`))
+	if err != nil {
+		log.Println("Unable to generate padding:", err)
+		return b
+	}
+	env.Padding = padding
+	b, err = json.Marshal(env)
+	if err != nil {
+		log.Println("Unable to json.Marshal envelope:", err)
+		return eventBody
+	}
+	return b
+}
+
+// openEnvelope - if str is an Envelope, return what's inside of it.
+func openEnvelope(str string) (string, bool, error) {
+	var env Envelope
+	if json.Unmarshal([]byte(str), &env) != nil || env.Compression == "" {
+		return "", false, nil
+	}
+	switch env.Compression {
+	case EnvelopeCompressionNone:
+		return string(env.Payload), true, nil
+	case EnvelopeCompressionDeflate:
+		fr := flate.NewReader(bytes.NewReader(env.Payload))
+		defer fr.Close()
+		b, err := io.ReadAll(io.LimitReader(fr, EnvelopeMaxSize+1))
+		if err != nil {
+			return "", true, err
+		}
+		if int64(len(b)) > EnvelopeMaxSize {
+			return "", true, errors.New("envelope is too big")
+		}
+		return string(b), true, nil
+	default:
+		return "", true, errors.New("unknown envelope compression: " + env.Compression)
+	}
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func testMessageEvent(text string) []byte {
+	return encodeEvent(Event{
+		EventType: EventTypeMessage,
+		Uuid:      "envelope-test",
+		Data: EventDataMixed{
+			EventDataMessage: EventDataMessage{Text: text, Type: MessageTypeText},
+		},
+	})
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	eventBody := testMessageEvent(strings.Repeat("hello ", 1000))
+	tests := []struct {
+		name         string
+		capabilities []string
+		compression  string
+	}{
+		{"none", []string{CapabilityEnvelope}, EnvelopeCompressionNone},
+		{"deflate", []string{CapabilityEnvelope, CapabilityDeflate}, EnvelopeCompressionDeflate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := sealEnvelope(&UserInfo{Capabilities: tt.capabilities}, eventBody)
+			if len(b) != envelopeBucket(len(b)) {
+				t.Fatal("envelope is not padded to a bucket:", len(b))
+			}
+			if !strings.Contains(string(b), `"p3penvelope":"`+tt.compression+`"`) {
+				t.Fatal("expected", tt.compression, "compression")
+			}
+			inner, ok, err := openEnvelope(string(b))
+			if err != nil || !ok {
+				t.Fatal("unable to open envelope:", ok, err)
+			}
+			if inner != string(eventBody) {
+				t.Fatal("envelope content differs")
+			}
+		})
+	}
+}
+
+func TestEnvelopeUnsupported(t *testing.T) {
+	eventBody := testMessageEvent("hello")
+	b := sealEnvelope(&UserInfo{}, eventBody)
+	if string(b) != string(eventBody) {
+		t.Fatal("event was sealed for a contact without", CapabilityEnvelope)
+	}
+	_, ok, _ := openEnvelope(string(b))
+	if ok {
+		t.Fatal("plain event taken for an envelope")
+	}
+}
+
+func TestEnvelopeTooBig(t *testing.T) {
+	defer func(size int64) { EnvelopeMaxSize = size }(EnvelopeMaxSize)
+	b := sealEnvelope(&UserInfo{Capabilities: []string{CapabilityEnvelope, CapabilityDeflate}},
+		testMessageEvent(strings.Repeat("a", 64*1024)))
+	EnvelopeMaxSize = 1024
+	_, ok, err := openEnvelope(string(b))
+	if !ok || err == nil {
+		t.Fatal("oversized envelope was opened")
+	}
+}
+
+func TestProcessStringEnvelope(t *testing.T) {
+	alice := createTestAccount(t, "alice")
+	bob := createTestAccount(t, "bob")
+	_, err := bob.CreateUserByPublicKey(alice.PublicKey, "alice", "local://127.0.0.1:1/alice", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ui := &UserInfo{Capabilities: []string{CapabilityEnvelope, CapabilityDeflate}}
+	sealed := sealEnvelope(ui, testMessageEvent("hello"))
+
+	encrypted, err := alice.EncryptSign(bob.PublicKey, string(sealed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	evts := processString(bob, encrypted, "")
+	if len(evts) != 1 || evts[0].Data.EventDataMessage.Text != "hello" {
+		t.Fatal("unexpected events", evts)
+	}
+	if !strings.EqualFold(StringToKeyID(evts[0].InternalKeyID), alice.GetKeyID()) {
+		t.Fatal("unexpected sender", evts[0].InternalKeyID)
+	}
+
+	if evts := processString(bob, string(sealed), ""); len(evts) != 0 {
+		t.Fatal("envelope was opened without being encrypted")
+	}
+	nested, err := alice.EncryptSign(bob.PublicKey, string(sealEnvelope(ui, sealed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evts := processString(bob, nested, ""); len(evts) != 0 {
+		t.Fatal("nested envelope was opened")
+	}
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// files.changed - sent whenever CreateFile or DeleteSharedFile changes
+// what a contact can see, so that they don't have to poll
+// .metadata.json. Receiving side keeps the listing in RemoteFile.
+
+type EventDataFilesChanged struct {
+	FileChanges []FileChange `json:"fileChanges,omitempty"`
+}
+
+type FileChange struct {
+	FilePath  string    `json:"filePath"`
+	Sha512Sum string    `json:"sha512sum,omitempty"`
+	SizeBytes int64     `json:"sizeBytes,omitempty"`
+	LastEdit  time.Time `json:"lastEdit"`
+	Deleted   bool      `json:"deleted,omitempty"`
+}
+
+// RemoteFile - cached listing of files shared with us. Deleted entries
+// are kept, so that changes arriving out of order don't bring them back.
+type RemoteFile struct {
+	gorm.Model
+	DBKeyID   string `gorm:"column:db_key_id;index"`
+	FilePath  string
+	Sha512Sum string
+	SizeBytes int64
+	LastEdit  time.Time
+	Deleted   bool
+}
+
+// GetCachedRemoteFiles - files that ui shares with us, as of the last
+// files.changed event or GetRemoteFiles call.
+func (pi *PrivateInfoS) GetCachedRemoteFiles(ui *UserInfo) (rfs []*RemoteFile) {
+	pi.DB.Order("file_path").Find(&rfs, "db_key_id = ? AND deleted = ?", ui.GetKeyID(), false)
+	return rfs
+}
+
+// sendFilesChanged - let the contact that sharedFor belongs to know
+// about fc.
+func (pi *PrivateInfoS) sendFilesChanged(sharedFor string, fc FileChange) {
+	ui, err := pi.GetUserInfoByKeyID(sharedFor)
+	if err != nil {
+		log.Println("files.changed: unknown contact:", sharedFor, err)
+		return
+	}
+	if ui.State != UserInfoStateAccepted || !ui.HasCapability(CapabilityFilesChanged) {
+		return
+	}
+	err = QueueEvent(pi, Event{
+		EventType: EventTypeFilesChanged,
+		Data: EventDataMixed{
+			EventDataFilesChanged: EventDataFilesChanged{
+				FileChanges: []FileChange{fc},
+			},
+		},
+	}, ui)
+	if err != nil {
+		log.Println("files.changed: unable to queue:", err)
+	}
+}
+
+// updateRemoteFile - apply fc to the cache, false if it is older than
+// what we already know.
+func (pi *PrivateInfoS) updateRemoteFile(ui *UserInfo, fc FileChange) bool {
+	var rf RemoteFile
+	pi.DB.First(&rf, "db_key_id = ? AND file_path = ?", ui.GetKeyID(), fc.FilePath)
+	if rf.ID != 0 && fc.LastEdit.Before(rf.LastEdit) {
+		return false
+	}
+	rf.DBKeyID = ui.GetKeyID()
+	rf.FilePath = fc.FilePath
+	rf.Sha512Sum = fc.Sha512Sum
+	rf.SizeBytes = fc.SizeBytes
+	rf.LastEdit = fc.LastEdit
+	rf.Deleted = fc.Deleted
+	pi.DB.Save(&rf)
+	return true
+}
+
+// refreshRemoteFiles - replace the cache with full listing of files
+// shared by ui.
+func (pi *PrivateInfoS) refreshRemoteFiles(ui *UserInfo, sfs []*SharedFile) {
+	listed := make(map[string]bool)
+	for _, sf := range sfs {
+		listed[sf.FilePath] = true
+		pi.updateRemoteFile(ui, FileChange{
+			FilePath:  sf.FilePath,
+			Sha512Sum: sf.Sha512Sum,
+			SizeBytes: sf.SizeBytes,
+			LastEdit:  sf.LastEdit,
+		})
+	}
+	for _, rf := range pi.GetCachedRemoteFiles(ui) {
+		if !listed[rf.FilePath] {
+			rf.Deleted = true
+			pi.DB.Save(rf)
+		}
+	}
+}
+
+// EventTypeFilesChanged     EventType = "files.changed"
+func (evt *Event) tryProcessFilesChanged(pi *PrivateInfoS) error {
+	log.Println("evt.tryProcessFilesChanged")
+	ui, err := pi.GetUserInfoByKeyID(evt.InternalKeyID)
+	if err != nil {
+		log.Println("WARN: files.changed from unknown contact, ignoring.", err)
+		return nil
+	}
+	if ui.State != UserInfoStateAccepted {
+		log.Println("WARN: files.changed from", ui.State, "contact, ignoring.")
+		return nil
+	}
+	var changes []FileChange
+	for _, fc := range evt.Data.EventDataFilesChanged.FileChanges {
+		if fc.FilePath == "" {
+			continue
+		}
+		if pi.updateRemoteFile(ui, fc) {
+			changes = append(changes, fc)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	pi.publish(NotificationFilesChanged, NotificationFilesChangedData{
+		UserInfoID: ui.ID,
+		KeyID:      ui.GetKeyID(),
+		Changes:    changes,
+	})
+	for i := range pi.FilesChangedCallback {
+		pi.FilesChangedCallback[i](pi, ui, changes)
+	}
+	return nil
+}
@@ -2,13 +2,54 @@ package core
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"time"
 )
 
-func QueueEvent(pi *PrivateInfoS, evt Event, ui *UserInfo) {
+// ErrEventTooBig - event is bigger than ChunkMaxSize, receivers would drop
+// it.
+var ErrEventTooBig = errors.New("event is too big to be sent")
+
+func QueueEvent(pi *PrivateInfoS, evt Event, ui *UserInfo) error {
 	if evt.Uuid == "" {
 		evt.RandomizeUuid()
 	}
+	eventBody := encodeEvent(evt)
+	if int64(len(eventBody)) > ChunkMaxSize {
+		log.Println("WARN: refusing to queue", evt.EventType, len(eventBody), "bytes")
+		return ErrEventTooBig
+	}
+	// log.Println("QUEUED_EVENT: ", string(eventBody))
+	// Chunks are bigger than ChunkThreshold once encoded, they must not
+	// be split again.
+	if evt.EventType != EventTypeIntroduce && evt.EventType != EventTypeChunk &&
+		len(eventBody) > ChunkThreshold && ui.HasCapability(CapabilityChunk) {
+		return queueChunks(pi, eventBody, ui)
+	}
+	body, err := pi.sealEvent(evt.EventType, eventBody, ui)
+	if err != nil {
+		log.Println("Unable to EncryptSign:", err)
+		return err
+	}
+	qevt := &QueuedEvent{
+		Body:      body,
+		Endpoint:  ui.Endpoint,
+		Mailboxes: ui.Mailboxes,
+		KeyID:     ui.GetKeyID(),
+		Pull:      ui.PullDelivery,
+		Uuid:      evt.Uuid,
+		EventType: evt.EventType,
+	}
+	if evt.Stamp != "" || !qevt.needsStamp(ui) {
+		qevt.BuiltAt = time.Now()
+	}
+	pi.saveQueuedEvent(qevt)
+	return nil
+}
+
+// encodeEvent - evt as it is sent over the wire, before encryption.
+func encodeEvent(evt Event) []byte {
 	var eventBody []byte
 	var err error
 	switch evt.EventType {
@@ -18,6 +59,12 @@ func QueueEvent(pi *PrivateInfoS, evt Event, ui *UserInfo) {
 		eventBody, err = json.Marshal(&evt.Data.EventDataIntroduceRequest)
 	case EventTypeMessage:
 		eventBody, err = json.Marshal(&evt.Data.EventDataMessage)
+	case EventTypeMailboxOffer:
+		eventBody, err = json.Marshal(&evt.Data.EventDataMailboxOffer)
+	case EventTypeChunk:
+		eventBody, err = json.Marshal(&evt.Data.EventDataChunk)
+	case EventTypeFilesChanged:
+		eventBody, err = json.Marshal(&evt.Data.EventDataFilesChanged)
 	default:
 		log.Println("WARN: Unable to queue event:", evt.EventType)
 	}
@@ -36,28 +83,31 @@ func QueueEvent(pi *PrivateInfoS, evt Event, ui *UserInfo) {
 		EventType: evt.EventType,
 		Data:      evtBodyDecoded,
 		Uuid:      evt.Uuid,
+		Stamp:     evt.Stamp,
 	}
 	eventBody, err = json.Marshal(&finalEvt)
 	if err != nil {
 		log.Println(err)
 	}
-	// log.Println("QUEUED_EVENT: ", string(eventBody))
-	if evt.EventType != EventTypeIntroduce {
-		ret, err := pi.EncryptSign(ui.Publickey, string(eventBody))
-		if err != nil {
-			log.Println("Unable to EncryptSign:", err)
-			return
-		}
-		pi.DB.Save(&QueuedEvent{
-			Body:     []byte(ret),
-			Endpoint: ui.Endpoint,
-		})
-		return
-	}
-	pi.DB.Save(&QueuedEvent{
-		Body:     eventBody,
-		Endpoint: ui.Endpoint,
-	})
+	return eventBody
+}
+
+// sealEvent - encrypt eventBody for ui, introduce events are the only
+// ones that travel in clear.
+func (pi *PrivateInfoS) sealEvent(eventType EventType, eventBody []byte, ui *UserInfo) ([]byte, error) {
+	if eventType == EventTypeIntroduce {
+		return eventBody, nil
+	}
+	ret, err := pi.EncryptSign(ui.Publickey, string(sealEnvelope(ui, eventBody)))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(ret), nil
+}
+
+func (pi *PrivateInfoS) saveQueuedEvent(qevt *QueuedEvent) {
+	pi.DB.Save(qevt)
+	pi.publish(NotificationQueued, qevt.notificationData())
 }
 
 func (pi *PrivateInfoS) GetAllQueuedEvents() (qevts []*QueuedEvent) {
@@ -65,6 +115,21 @@ func (pi *PrivateInfoS) GetAllQueuedEvents() (qevts []*QueuedEvent) {
 	return qevts
 }
 
+// RetryQueuedEvent - relay qevt now, ignoring the backoff of it's
+// endpoints.
+func (pi *PrivateInfoS) RetryQueuedEvent(qevt *QueuedEvent) error {
+	if qevt.ID == 0 {
+		return errors.New("queued event not found")
+	}
+	if qevt.Pull {
+		return errors.New("event waits in outbox.http, it can't be relayed")
+	}
+	for _, endpoint := range qevt.relayEndpoints(pi) {
+		pi.getEndpointStats(endpoint).Reset(pi)
+	}
+	return qevt.Relay(pi)
+}
+
 func (pi *PrivateInfoS) GetQueuedEvent(queuedEventID int) (qevt *QueuedEvent) {
 	qevt = &QueuedEvent{}
 	pi.DB.First(qevt, "id = ?", queuedEventID)
@@ -5,9 +5,10 @@ import (
 	"errors"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
-	"sync"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -28,6 +29,22 @@ type QueuedEvent struct {
 	LastRelayed time.Time
 	Body        []byte
 	Endpoint    Endpoint
+	// Mailboxes - store-and-forward endpoints advertised by the
+	// recipient, used when Endpoint is unreachable.
+	Mailboxes []Endpoint `gorm:"serializer:json"`
+	// KeyID - recipient of the event.
+	KeyID string
+	// Pull - event is not relayed, instead it waits in outbox.http
+	// for the recipient to pick it up.
+	Pull bool `gorm:"default:false"`
+	// Uuid - of the event inside Body, that's what DeliveryAck refers to.
+	Uuid string
+	// EventType - of the event inside Body.
+	EventType EventType
+	// BuiltAt - when Body was built. Signatures and stamps on
+	// introductions expire, so these are built again when they are
+	// relayed late, see rebuild.
+	BuiltAt time.Time
 }
 
 func (evt *QueuedEvent) GetEndpointStats(pi *PrivateInfoS) *EndpointStats {
@@ -38,25 +55,115 @@ func (evt *QueuedEvent) Relay(pi *PrivateInfoS) error {
 	evt.LastRelayed = time.Now()
 	evt.RelayTries++
 	pi.DB.Save(evt)
-	es := evt.GetEndpointStats(pi)
-	if !es.ShouldRelayNow(pi) {
-		return errors.New("es.ShouldRelayNow says we shouldn't relay it")
+	err := evt.rebuild(pi)
+	if err != nil {
+		return err
 	}
-	host := evt.Endpoint.GetHost()
-	if host == "" || host == "http://:" || host == "http://" {
+	endpoints := evt.relayEndpoints(pi)
+	if len(endpoints) == 0 {
 		log.Println("Removed event from queue:", evt.ID, "reason: host is not found")
 		pi.DB.Delete(evt)
 		return errors.New("host is empty - removed queued event")
 	}
-	_, err := i2pPost(host, evt.Body)
+	for _, endpoint := range endpoints {
+		err = evt.relayTo(pi, endpoint)
+		if err == nil {
+			pi.DB.Delete(evt)
+			n := evt.notificationData()
+			n.Endpoint = endpoint
+			pi.publish(NotificationDelivered, n)
+			return nil
+		}
+		log.Println("Unable to relay", evt.ID, "to", endpoint, err)
+	}
+	n := evt.notificationData()
+	n.Error = err.Error()
+	pi.publish(NotificationDeliveryFailed, n)
+	return err
+}
+
+// needsStamp - introductions to users that want proof of work are
+// queued without a stamp, it is minted by rebuild in the relay goroutine.
+func (evt *QueuedEvent) needsStamp(ui *UserInfo) bool {
+	return (evt.EventType == EventTypeIntroduce || evt.EventType == EventTypeIntroduceRequest) && ui.StampBits != 0
+}
+
+// rebuild - build introductions that are not fresh anymore (or were never
+// stamped) again, so that their signature and stamp are still valid when
+// they arrive. Uuid stays the same, acks and dedupe keep working.
+func (evt *QueuedEvent) rebuild(pi *PrivateInfoS) error {
+	if evt.EventType != EventTypeIntroduce && evt.EventType != EventTypeIntroduceRequest {
+		return nil
+	}
+	if !evt.BuiltAt.IsZero() && time.Since(evt.BuiltAt) < min(IntroduceMaxAge, StampMaxAge)/2 {
+		return nil
+	}
+	ui, err := pi.GetUserInfoByKeyID(evt.KeyID)
+	if err != nil {
+		// Nothing to build it from, send it as it is.
+		return nil
+	}
+	var fresh Event
+	if evt.EventType == EventTypeIntroduce {
+		fresh, err = pi.introduceEvent(ui)
+		if err != nil {
+			return err
+		}
+	} else {
+		fresh = pi.introduceRequestEvent(ui)
+	}
+	fresh.Uuid = evt.Uuid
+	fresh.Stamp = pi.stampFor(ui)
+	body, err := pi.sealEvent(fresh.EventType, encodeEvent(fresh), ui)
+	if err != nil {
+		return err
+	}
+	evt.Body = body
+	evt.BuiltAt = time.Now()
+	pi.DB.Save(evt)
+	return nil
+}
+
+// relayEndpoints - endpoints to try, in order. If we still know the
+// recipient their current endpoints and mailboxes are used, so we fail
+// over to the next one instead of waiting for a dead address, otherwise
+// we fall back to Endpoint and Mailboxes stored along with the event.
+func (evt *QueuedEvent) relayEndpoints(pi *PrivateInfoS) (endpoints []Endpoint) {
+	candidates := append([]Endpoint{evt.Endpoint}, evt.Mailboxes...)
+	if evt.KeyID != "" {
+		ui, err := pi.GetUserInfoByKeyID(evt.KeyID)
+		if err == nil {
+			candidates = append(ui.GetEndpoints(), ui.Mailboxes...)
+		}
+	}
+	for _, endpoint := range mergeEndpoints(candidates) {
+		host := endpoint.GetHost()
+		if host == "" || strings.HasSuffix(host, "://:") || strings.HasSuffix(host, "://") {
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints
+}
+
+func (evt *QueuedEvent) relayTo(pi *PrivateInfoS, endpoint Endpoint) error {
+	es := pi.getEndpointStats(endpoint)
+	if !es.ShouldRelayNow(pi) {
+		return errors.New("es.ShouldRelayNow says we shouldn't relay it")
+	}
+	start := time.Now()
+	resp, err := i2pPostAs(endpoint.GetHost(), evt.Body, pi.pullFingerprint())
+	took := time.Since(start)
 	if err != nil {
-		// DB.Delete(evt)
 		es.Fail(pi)
+		pi.metricsRelay(endpoint, took, err)
 		return err
 	}
+	// Endpoint has answered, whether or not the event got processed.
 	es.SuccessOut(pi)
-	pi.DB.Delete(evt)
-	return nil
+	err = evt.checkDeliveryAck(pi, endpoint, resp)
+	pi.metricsRelay(endpoint, took, err)
+	return err
 }
 
 func (pi *PrivateInfoS) getEndpointStats(endpoint Endpoint) *EndpointStats {
@@ -130,6 +237,13 @@ func (es *EndpointStats) SuccessOut(pi *PrivateInfoS) {
 //	pi.DB.Save(es)
 //}
 
+// Reset - forget failures, next relay will be attempted right away.
+func (es *EndpointStats) Reset(pi *PrivateInfoS) {
+	es.FailInRow = 0
+	es.CurrentDelay = 0
+	pi.DB.Save(es)
+}
+
 func (es *EndpointStats) ShouldRelayNow(pi *PrivateInfoS) bool {
 	if es.FailInRow <= 0 {
 		es.CurrentDelay = 0
@@ -174,28 +288,88 @@ func (es *EndpointStats) ShouldRelayNow(pi *PrivateInfoS) bool {
 }
 
 func GetQueuedEvents(pi *PrivateInfoS) (evts []*QueuedEvent) {
-	pi.DB.Order("RANDOM()").Limit(50).Find(&evts)
+	pi.DB.Order("RANDOM()").Limit(50).Find(&evts, "pull = ?", false)
 	return evts
 }
 
 var I2P_HTTP_PROXY = "http://127.0.0.1:4444"
 
-func i2pHttpTransport() *http.Transport {
+// LOCAL_ENDPOINTS_DIRECT - reach local:// endpoints on loopback directly
+// instead of through I2P_HTTP_PROXY. Any contact can announce a local://
+// endpoint, so this is meant only for tests running several accounts
+// on one LocalServer.
+var LOCAL_ENDPOINTS_DIRECT = false
+
+// i2pRoute - turn uri returned by Endpoint.GetHost into a http url and
+// the transport to request it with.
+func i2pRoute(uri string) (string, *http.Transport) {
 	proxyUrl, err := url.Parse(I2P_HTTP_PROXY)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	return &http.Transport{Proxy: http.ProxyURL(proxyUrl)}
+	if rest, ok := strings.CutPrefix(uri, "local://"); ok {
+		uri = "http://" + rest
+		req, err := url.Parse(uri)
+		if err == nil && LOCAL_ENDPOINTS_DIRECT && isLoopbackHost(req.Hostname()) {
+			return uri, &http.Transport{}
+		}
+	}
+	return uri, &http.Transport{Proxy: http.ProxyURL(proxyUrl)}
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 func i2pPost(uri string, body []byte) ([]byte, error) {
-	httpClient := &http.Client{Transport: i2pHttpTransport(), Timeout: time.Second * 60}
+	return i2pRequest("POST", uri, body, "", time.Second*60)
+}
+
+// i2pPostAs - i2pPost that tells the receiver who we are, see
+// outboxHeader. fingerprint is left out when it is empty.
+func i2pPostAs(uri string, body []byte, fingerprint string) ([]byte, error) {
+	header := http.Header{}
+	if fingerprint != "" {
+		header.Set(outboxHeader, fingerprint)
+	}
+	return i2pDo("POST", uri, body, header, time.Second*60)
+}
+
+func i2pGet(uri string) ([]byte, error) {
+	return i2pRequest("GET", uri, nil, "", time.Second*14)
+}
+
+// I2P_MAX_RESPONSE_SIZE - i2pRequest refuses to read bigger responses,
+// so that a contact can't make us buffer an endless .metadata.json.
+var I2P_MAX_RESPONSE_SIZE int64 = 64 * 1024 * 1024
+
+// i2pRequest - perform a request through I2P_HTTP_PROXY, if auth is not
+// empty it is sent as a bearer in Authentication header (the same way
+// files.http and mailbox.http expect it).
+func i2pRequest(method string, uri string, body []byte, auth string, timeout time.Duration) ([]byte, error) {
+	header := http.Header{}
+	if auth != "" {
+		header.Set("Authentication", "Bearer "+auth)
+	}
+	return i2pDo(method, uri, body, header, timeout)
+}
+
+func i2pDo(method string, uri string, body []byte, header http.Header, timeout time.Duration) ([]byte, error) {
+	uri, transport := i2pRoute(uri)
+	httpClient := &http.Client{Transport: transport, Timeout: timeout}
 	// log.Println("Body:" + string(body))
-	req, err := http.NewRequest("POST", uri, bytes.NewReader(body))
-	req.Header.Set("Content-Type", "application/octet-stream")
+	req, err := http.NewRequest(method, uri, bytes.NewReader(body))
 	if err != nil {
 		return []byte{}, err
 	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for key := range header {
+		req.Header.Set(key, header.Get(key))
+	}
 	_, err = http2curl.GetCurlCommand(req)
 	if err != nil {
 		log.Fatalln(err)
@@ -204,58 +378,58 @@ func i2pPost(uri string, body []byte) ([]byte, error) {
 	if err != nil {
 		return []byte{}, err
 	}
-	if respbody.StatusCode != 200 {
-		return []byte{}, errors.New("unknown server response")
-	}
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
 		if err != nil {
 			log.Println("Failed to .Close()", err)
 		}
 	}(respbody.Body)
-	b, err := io.ReadAll(respbody.Body)
+	if respbody.StatusCode != 200 && respbody.StatusCode != 202 {
+		return []byte{}, errors.New("unknown server response")
+	}
+	b, err := io.ReadAll(io.LimitReader(respbody.Body, I2P_MAX_RESPONSE_SIZE+1))
 	if err != nil {
 		log.Println(err)
 		return b, err
 	}
+	if int64(len(b)) > I2P_MAX_RESPONSE_SIZE {
+		return []byte{}, errors.New("response is too big")
+	}
 	log.Println("OK:", string(b))
 	return b, nil
 }
 
-func i2pGet(uri string) ([]byte, error) {
-	httpClient := &http.Client{Transport: i2pHttpTransport(), Timeout: time.Second * 14}
-	// log.Println("Body:" + string(body))
-	req, err := http.NewRequest("GET", uri, nil)
-	req.Header.Set("Content-Type", "application/octet-stream")
-	if err != nil {
-		return []byte{}, err
-	}
-	_, err = http2curl.GetCurlCommand(req)
-	if err != nil {
-		log.Fatalln(err)
+// startRelay - whether EventQueueRunner should relay to endpoint now,
+// endpoint is marked as running until finishRelay.
+func (pi *PrivateInfoS) startRelay(endpoint Endpoint) bool {
+	pi.relayLock.Lock()
+	defer pi.relayLock.Unlock()
+	if pi.relayTimeout == nil {
+		pi.relayTimeout = make(map[string]int)
+		pi.relayRunning = make(map[string]bool)
 	}
-	respbody, err := httpClient.Do(req)
-	if err != nil {
-		return []byte{}, err
+	if pi.relayTimeout[string(endpoint)] > 0 {
+		pi.relayTimeout[string(endpoint)]--
+		return false
 	}
-	if respbody.StatusCode != 200 {
-		return []byte{}, errors.New("unknown server response")
+	if pi.relayRunning[string(endpoint)] {
+		return false
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Println("Failed to .Close()", err)
-		}
-	}(respbody.Body)
-	b, err := io.ReadAll(respbody.Body)
-	log.Println("OK:", string(b))
-	return b, nil
+	pi.relayRunning[string(endpoint)] = true
+	return true
 }
 
-var queueTimeout = make(map[string]int)
-var queueLock = make(map[string]*sync.Mutex)
+func (pi *PrivateInfoS) finishRelay(endpoint Endpoint, err error) {
+	pi.relayLock.Lock()
+	defer pi.relayLock.Unlock()
+	delete(pi.relayRunning, string(endpoint))
+	if err != nil {
+		pi.relayTimeout[string(endpoint)] = 60
+	}
+}
 
 func (pi *PrivateInfoS) EventQueueRunner() {
+	stop := pi.stop
 	for {
 		var emptyList []Endpoint
 	OuterLoop:
@@ -265,33 +439,22 @@ func (pi *PrivateInfoS) EventQueueRunner() {
 					break OuterLoop
 				}
 			}
-			_, ok := queueLock[string(evt.Endpoint)]
-			if !ok {
-				queueLock[string(evt.Endpoint)] = &sync.Mutex{}
-			}
-			_, ok = queueTimeout[string(evt.Endpoint)]
-			if !ok {
-				queueTimeout[string(evt.Endpoint)] = 0
-			}
-
 			emptyList = append(emptyList, evt.Endpoint)
-			if queueTimeout[string(evt.Endpoint)] > 0 {
-				queueTimeout[string(evt.Endpoint)]--
+			if !pi.startRelay(evt.Endpoint) {
 				continue
 			}
-			go func(evt *QueuedEvent) {
-				if !queueLock[string(evt.Endpoint)].TryLock() {
-					return
-				}
+			evt := evt
+			pi.goRun(func() {
 				log.Println("processing event:", evt.ID)
 				err := evt.Relay(pi)
 				if err != nil {
 					log.Println("Failed to relay event:", err)
-					queueTimeout[string(evt.Endpoint)] = 60
 				}
-				queueLock[string(evt.Endpoint)].Unlock()
-			}(evt)
+				pi.finishRelay(evt.Endpoint, err)
+			})
+		}
+		if !pi.sleepOrStop(stop, time.Second*1) {
+			return
 		}
-		time.Sleep(time.Second * 1)
 	}
 }
@@ -0,0 +1,266 @@
+package core
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cavaliergopher/grab/v3"
+	"gorm.io/gorm"
+)
+
+// Download client - counterpart of FileServe, uses SharedFilesMetadata
+// received in contact's introduce to list and fetch the files that they
+// share with us. Downloads are resumed from where they have stopped and
+// verified against Sha512Sum, they end up in GetDownloadsDir.
+
+const (
+	DownloadStatusPending = "pending"
+	DownloadStatusRunning = "running"
+	DownloadStatusDone    = "done"
+	DownloadStatusFailed  = "failed"
+)
+
+// DOWNLOAD_PROGRESS_INTERVAL - how often running downloads report
+// progress.
+var DOWNLOAD_PROGRESS_INTERVAL = time.Millisecond * 500
+
+// DOWNLOAD_HEADER_TIMEOUT - how long we wait for the contact to answer a
+// download request.
+var DOWNLOAD_HEADER_TIMEOUT = time.Second * 120
+
+// DOWNLOAD_STALL_TIMEOUT - running downloads that receive nothing for
+// that long are cancelled, downloading the file again resumes them.
+var DOWNLOAD_STALL_TIMEOUT = time.Second * 120
+
+type Download struct {
+	gorm.Model
+	DBKeyID       string `gorm:"column:db_key_id;index"`
+	FilePath      string
+	Sha512Sum     string
+	SizeBytes     int64
+	BytesDone     int64
+	Status        string
+	LastError     string
+	LocalFilePath string
+}
+
+// getRemoteFilesMetadata - where and how to reach files shared by ui.
+func (pi *PrivateInfoS) getRemoteFilesMetadata(ui *UserInfo) (*SharedFilesMetadata, error) {
+	var sfms []*SharedFilesMetadata
+	pi.DB.Find(&sfms, "db_key_id = ?", ui.GetKeyID())
+	for i := range sfms {
+		if sfms[i].FilesEndpoint != "" {
+			return sfms[i], nil
+		}
+	}
+	return nil, errors.New("user doesn't share any files with us")
+}
+
+func remoteFileURL(sfm *SharedFilesMetadata, filePath string) string {
+	if !strings.HasPrefix(filePath, "/") {
+		filePath = "/" + filePath
+	}
+	return sfm.FilesEndpoint.GetHost() + (&url.URL{Path: filePath}).EscapedPath()
+}
+
+// GetRemoteFiles - list of files that ui shares with us.
+func (pi *PrivateInfoS) GetRemoteFiles(ui *UserInfo) ([]*SharedFile, error) {
+	sfm, err := pi.getRemoteFilesMetadata(ui)
+	if err != nil {
+		return nil, err
+	}
+	b, err := i2pRequest("GET", remoteFileURL(sfm, "/.metadata.json"), nil, sfm.Authentication, time.Second*60)
+	if err != nil {
+		return nil, err
+	}
+	var sfs []*SharedFile
+	err = json.Unmarshal(b, &sfs)
+	if err != nil {
+		return nil, err
+	}
+	pi.refreshRemoteFiles(ui, sfs)
+	return sfs, nil
+}
+
+// GetDownloadsDir - where files downloaded from ui are stored.
+func (pi *PrivateInfoS) GetDownloadsDir(ui *UserInfo) string {
+	return path.Join(pi.StorePath, "downloads", ui.GetKeyID())
+}
+
+// localDownloadPath - filePath inside of dir, remote side doesn't get to
+// write outside of it.
+func localDownloadPath(dir string, filePath string) (string, error) {
+	rel := filepath.Clean("/" + filepath.FromSlash(filePath))
+	if rel == string(filepath.Separator) {
+		return "", errors.New("invalid file path")
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+func (pi *PrivateInfoS) GetDownloads(ui *UserInfo) (ds []*Download) {
+	pi.DB.Order("id").Find(&ds, "db_key_id = ?", ui.GetKeyID())
+	return ds
+}
+
+func (pi *PrivateInfoS) GetDownloadByID(id uint) *Download {
+	var d Download
+	pi.DB.First(&d, "id = ?", id)
+	return &d
+}
+
+// DownloadRemoteFile - start downloading filePath shared by ui in the
+// background, see DownloadCallback for progress.
+func (pi *PrivateInfoS) DownloadRemoteFile(ui *UserInfo, filePath string) (*Download, error) {
+	sfs, err := pi.GetRemoteFiles(ui)
+	if err != nil {
+		return nil, err
+	}
+	for _, sf := range sfs {
+		if sf.FilePath != filePath {
+			continue
+		}
+		d, err := pi.prepareDownload(ui, sf, pi.GetDownloadsDir(ui))
+		if err != nil {
+			return nil, err
+		}
+		pi.goRun(func() {
+			err := pi.runDownload(ui, d)
+			if err != nil {
+				log.Println("Download failed:", d.FilePath, err)
+			}
+		})
+		return d, nil
+	}
+	return nil, errors.New("user doesn't share given file with us")
+}
+
+// prepareDownload - Download of sf into dir, existing one is reused so
+// that it can be resumed.
+func (pi *PrivateInfoS) prepareDownload(ui *UserInfo, sf *SharedFile, dir string) (*Download, error) {
+	localFilePath, err := localDownloadPath(dir, sf.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	return pi.prepareDownloadTo(ui, sf, localFilePath)
+}
+
+// prepareDownloadTo - same as prepareDownload, into localFilePath.
+func (pi *PrivateInfoS) prepareDownloadTo(ui *UserInfo, sf *SharedFile, localFilePath string) (*Download, error) {
+	var d Download
+	pi.DB.First(&d, "db_key_id = ? AND file_path = ? AND sha512_sum = ?", ui.GetKeyID(), sf.FilePath, sf.Sha512Sum)
+	var last Download
+	pi.DB.Order("updated_at desc").First(&last, "db_key_id = ? AND file_path = ?", ui.GetKeyID(), sf.FilePath)
+	if last.ID != d.ID {
+		// Local file belongs to another version, it can't be resumed.
+		os.Remove(localFilePath)
+	}
+	d.DBKeyID = ui.GetKeyID()
+	d.FilePath = sf.FilePath
+	d.Sha512Sum = sf.Sha512Sum
+	d.SizeBytes = sf.SizeBytes
+	d.LocalFilePath = localFilePath
+	if d.Status != DownloadStatusDone || !fileExists(localFilePath) {
+		d.Status = DownloadStatusPending
+	}
+	pi.DB.Save(&d)
+	return &d, nil
+}
+
+// runDownload - download d, blocking until it is done.
+func (pi *PrivateInfoS) runDownload(ui *UserInfo, d *Download) error {
+	if d.Status == DownloadStatusDone {
+		return nil
+	}
+	if _, running := pi.runningDownloads.LoadOrStore(d.ID, true); running {
+		return errors.New("download is already running")
+	}
+	defer pi.runningDownloads.Delete(d.ID)
+	err := pi.grabDownload(ui, d)
+	if err != nil {
+		d.Status = DownloadStatusFailed
+		d.LastError = err.Error()
+	} else {
+		d.Status = DownloadStatusDone
+		d.LastError = ""
+		d.BytesDone = d.SizeBytes
+	}
+	pi.DB.Save(d)
+	pi.downloadProgress(ui, d)
+	return err
+}
+
+func (pi *PrivateInfoS) grabDownload(ui *UserInfo, d *Download) error {
+	sfm, err := pi.getRemoteFilesMetadata(ui)
+	if err != nil {
+		return err
+	}
+	sum, err := hex.DecodeString(d.Sha512Sum)
+	if err != nil {
+		return err
+	}
+	uri, transport := i2pRoute(remoteFileURL(sfm, d.FilePath))
+	req, err := grab.NewRequest(d.LocalFilePath, uri)
+	if err != nil {
+		return err
+	}
+	req.HTTPRequest.Header.Set("Authentication", "Bearer "+sfm.Authentication)
+	req.Size = d.SizeBytes
+	req.SetChecksum(sha512.New(), sum, true)
+	transport.ResponseHeaderTimeout = DOWNLOAD_HEADER_TIMEOUT
+	transport.IdleConnTimeout = DOWNLOAD_STALL_TIMEOUT
+	client := grab.NewClient()
+	client.HTTPClient = &http.Client{Transport: transport}
+
+	d.Status = DownloadStatusRunning
+	d.LastError = ""
+	pi.DB.Save(d)
+	resp := client.Do(req)
+	ticker := time.NewTicker(DOWNLOAD_PROGRESS_INTERVAL)
+	defer ticker.Stop()
+	lastProgress := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			done := resp.BytesComplete()
+			if done != d.BytesDone {
+				lastProgress = time.Now()
+			} else if time.Since(lastProgress) > DOWNLOAD_STALL_TIMEOUT {
+				_ = resp.Cancel()
+				return errors.New("download stalled")
+			}
+			d.BytesDone = done
+			pi.DB.Save(d)
+			pi.downloadProgress(ui, d)
+		case <-resp.Done:
+			return resp.Err()
+		case <-pi.stop:
+			_ = resp.Cancel()
+			return errors.New("account got closed")
+		}
+	}
+}
+
+func (pi *PrivateInfoS) downloadProgress(ui *UserInfo, d *Download) {
+	pi.publish(NotificationDownload, NotificationDownloadData{
+		DownloadID: d.ID,
+		KeyID:      d.DBKeyID,
+		FilePath:   d.FilePath,
+		BytesDone:  d.BytesDone,
+		SizeBytes:  d.SizeBytes,
+		Status:     d.Status,
+		Error:      d.LastError,
+	})
+	for i := range pi.DownloadCallback {
+		pi.DownloadCallback[i](pi, ui, d)
+	}
+}
@@ -36,11 +36,30 @@ type SharedFile struct {
 }
 
 func (pi *PrivateInfoS) DeleteSharedFile(sf *SharedFile) {
-	err := os.Remove(sf.LocalFilePath)
+	pi.DB.Delete(sf)
+	pi.removeUnusedBlob(sf.LocalFilePath)
+	pi.sendFilesChanged(sf.SharedFor, FileChange{
+		FilePath: sf.FilePath,
+		LastEdit: time.Now(),
+		Deleted:  true,
+	})
+}
+
+// removeUnusedBlob - remove stored copy of a file unless another
+// SharedFile with the same content still uses it.
+func (pi *PrivateInfoS) removeUnusedBlob(localFilePath string) {
+	if localFilePath == "" {
+		return
+	}
+	var count int64
+	pi.DB.Model(&SharedFile{}).Where("local_file_path = ?", localFilePath).Count(&count)
+	if count != 0 {
+		return
+	}
+	err := os.Remove(localFilePath)
 	if err != nil {
 		log.Println(err)
 	}
-	pi.DB.Delete(sf)
 }
 
 func (pi *PrivateInfoS) RemoteFilesAccessBearer(ui *UserInfo) string {
@@ -59,14 +78,14 @@ func (pi *PrivateInfoS) RemoteFilesAccessBearer(ui *UserInfo) string {
 }
 
 // FileServe - Handle all file requests
-// r.Get("/files.http/{sharedFor}/*", FileServe)
-func FileServe(w http.ResponseWriter, r *http.Request) {
+// r.Get("/files.http/{sharedFor}/*", ls.FileServe)
+func (ls *LocalServer) FileServe(w http.ResponseWriter, r *http.Request) {
 	sharedFor := chi.URLParam(r, "sharedFor")
-	filePath := strings.ReplaceAll(r.RequestURI, fmt.Sprintf("/files.http/%s", sharedFor), "")
+	filePath := strings.ReplaceAll(r.URL.Path, fmt.Sprintf("/files.http/%s", sharedFor), "")
 	auth := r.Header.Get("Authentication")
 	log.Printf("FILE_SERVE(%s): %s: %s [auth: %s]\n", sharedFor, r.RequestURI, filePath, auth)
 
-	pi, err := getPrivateInfoBySharedFor(sharedFor, auth)
+	pi, err := ls.Accounts.bySharedFor(sharedFor, auth)
 	if err != nil {
 		w.WriteHeader(403)
 		_, err := w.Write([]byte(err.Error()))
@@ -76,6 +95,7 @@ func FileServe(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	defer pi.release()
 
 	if filePath == "/.metadata.json" {
 		log.Println("\t-> /.metadata.json")
@@ -100,53 +120,50 @@ func FileServe(w http.ResponseWriter, r *http.Request) {
 		_, err := w.Write([]byte("Unable to find given file"))
 		if err != nil {
 			log.Println(err)
-			return
 		}
+		return
 	}
 	http.ServeFile(w, r, sf.LocalFilePath)
 }
 
-func getPrivateInfoBySharedFor(sharedFor string, auth string) (*PrivateInfoS, error) {
+// bySharedFor - account that shares files with sharedFor, using auth.
+// Returned account is in use, release it when you are done.
+func (ar *AccountRegistry) bySharedFor(sharedFor string, auth string) (*PrivateInfoS, error) {
 	if strings.HasPrefix(auth, "Bearer ") {
 		auth = auth[len("Bearer "):]
 	}
 	if sharedFor == "" || auth == "" {
 		return nil, errors.New("invalid data provided. No auth or sharedFor")
 	}
-	for i := range privateInfoMap {
-		var sfb SharedForBearer
-		privateInfoMap[i].DB.First(&sfb, "shared_for = ? AND bearer = ?", sharedFor, auth)
-		if sfb.SharedFor == sharedFor && sfb.Bearer == auth {
-			return privateInfoMap[i], nil
+	var found *PrivateInfoS
+	for _, pi := range ar.using() {
+		if found == nil {
+			var sfb SharedForBearer
+			pi.DB.First(&sfb, "shared_for = ? AND bearer = ?", sharedFor, auth)
+			if sfb.SharedFor == sharedFor && sfb.Bearer == auth {
+				found = pi
+				continue
+			}
 		}
+		pi.release()
+	}
+	if found == nil {
+		return nil, errors.New("unable to find given pi")
 	}
-	return nil, errors.New("unable to find given pi")
+	return found, nil
 }
 
 func (pi *PrivateInfoS) CreateFile(ui *UserInfo, localFilePath string, remoteFilePath string) error {
 	sharedFor := ui.GetKeyID()
 	var sf SharedFile
-	pi.DB.First(sf, "shared_for = ? AND file_path = ?", sharedFor, remoteFilePath)
-	f, err := os.Open(localFilePath)
+	pi.DB.First(&sf, "shared_for = ? AND file_path = ?", sharedFor, remoteFilePath)
+	sum, err := fileSha512(localFilePath)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	h := sha512.New()
-	_, err = io.Copy(h, f)
-	if err != nil {
-		return err
-	}
-
-	sum := hex.EncodeToString(h.Sum(nil))
 
 	localStorePath := path.Join(pi.StorePath, "files-http", ui.GetKeyID(), sum)
-
-	if fileExists(localStorePath) {
-		log.Println("file exists:", localStorePath)
-		return errors.New("file with given sha512 checksum already exists")
-	}
+	oldStorePath := sf.LocalFilePath
 	//SharedFor     string `json:"-"`
 	sf.SharedFor = ui.GetKeyID()
 	//Sha512Sum     string `json:"sha512sum"`
@@ -158,26 +175,58 @@ func (pi *PrivateInfoS) CreateFile(ui *UserInfo, localFilePath string, remoteFil
 	//LocalFilePath string `json:"-"`
 	sf.LocalFilePath = localStorePath
 
-	size, err := copyFile(localFilePath, localStorePath)
-	if err != nil {
-		return err
+	if fileExists(localStorePath) {
+		// Same content is already shared under another path.
+		log.Println("file exists:", localStorePath)
+		fi, err := os.Stat(localStorePath)
+		if err != nil {
+			return err
+		}
+		sf.SizeBytes = fi.Size()
+	} else {
+		size, err := copyFile(localFilePath, localStorePath)
+		if err != nil {
+			return err
+		}
+		sf.SizeBytes = size
 	}
-
-	sf.SizeBytes = size
 	pi.DB.Save(&sf)
+	if oldStorePath != localStorePath {
+		pi.removeUnusedBlob(oldStorePath)
+		pi.sendFilesChanged(sf.SharedFor, FileChange{
+			FilePath:  sf.FilePath,
+			Sha512Sum: sf.Sha512Sum,
+			SizeBytes: sf.SizeBytes,
+			LastEdit:  sf.LastEdit,
+		})
+	}
 	return nil
 }
 
+func fileSha512(localFilePath string) (string, error) {
+	f, err := os.Open(localFilePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha512.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func (pi *PrivateInfoS) GetSharedFiles(ui *UserInfo) (sfs []*SharedFile) {
 	sharedFor := ui.GetKeyID()
-	pi.DB.Find(sfs, "shared_for = ?", sharedFor)
+	pi.DB.Find(&sfs, "shared_for = ?", sharedFor)
 	return sfs
 }
 
 func (pi *PrivateInfoS) GetSharedFilesMetadata(ui *UserInfo) (sfm SharedFilesMetadata) {
 	sharedFor := ui.GetKeyID()
 	return SharedFilesMetadata{
-		FilesEndpoint:  Endpoint(strings.ReplaceAll(fmt.Sprintf("%s/files.http/%s", pi.Endpoint.GetHost(), sharedFor), "//files.http", "/files.http")),
+		FilesEndpoint:  pi.Endpoint.WithPath("/files.http/" + sharedFor),
 		Authentication: pi.RemoteFilesAccessBearer(ui),
 	}
 }
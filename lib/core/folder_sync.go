@@ -0,0 +1,357 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Folder sync - local directory paired with a contact, both sides share
+// their copy of it under /sync/<name>/ and pull the other side's copy
+// through files.http. SyncedFile keeps what we knew about every file
+// the last time, so that we can tell who changed or deleted it. When
+// both sides have changed the same file, the remote version is stored
+// next to ours as a conflict copy. Conflict copies are local only, they
+// are not shared back until the user renames them.
+
+// SYNC_FOLDER_INTERVAL - how often SyncFolderRunner scans and pulls.
+var SYNC_FOLDER_INTERVAL = time.Minute
+
+type SyncFolder struct {
+	gorm.Model
+	DBKeyID string `gorm:"column:db_key_id;index"`
+	// Name - has to be the same on both sides.
+	Name      string
+	LocalPath string
+	LastSync  time.Time
+	LastError string
+}
+
+type SyncedFile struct {
+	gorm.Model
+	SyncFolderID uint `gorm:"index"`
+	RelPath      string
+	// Local* - state of our copy, as of the last scan.
+	LocalSha512Sum string
+	LocalSize      int64
+	LocalModTime   time.Time
+	LocalDeleted   bool
+	// SyncedSha512Sum - content that both sides have agreed on.
+	SyncedSha512Sum string
+	// RemoteSha512Sum - remote content that we have already handled.
+	RemoteSha512Sum string
+}
+
+// AddSyncFolder - start syncing localPath with ui, under given name.
+func (pi *PrivateInfoS) AddSyncFolder(ui *UserInfo, name string, localPath string) (*SyncFolder, error) {
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return nil, errors.New("invalid sync folder name")
+	}
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", localPath)
+	}
+	var sfo SyncFolder
+	pi.DB.First(&sfo, "db_key_id = ? AND name = ?", ui.GetKeyID(), name)
+	sfo.DBKeyID = ui.GetKeyID()
+	sfo.Name = name
+	sfo.LocalPath = localPath
+	pi.DB.Save(&sfo)
+	return &sfo, nil
+}
+
+func (pi *PrivateInfoS) GetSyncFolders() (sfos []*SyncFolder) {
+	pi.DB.Order("id").Find(&sfos)
+	return sfos
+}
+
+func (pi *PrivateInfoS) GetSyncFolderByID(id uint) *SyncFolder {
+	var sfo SyncFolder
+	pi.DB.First(&sfo, "id = ?", id)
+	return &sfo
+}
+
+// DeleteSyncFolder - stop syncing, our shared copy is removed while local
+// files are left alone.
+func (pi *PrivateInfoS) DeleteSyncFolder(sfo *SyncFolder) {
+	var sfs []*SharedFile
+	pi.DB.Find(&sfs, "shared_for = ?", sfo.DBKeyID)
+	for _, sf := range sfs {
+		// Compared here rather than with LIKE, folder names may contain
+		// '%' and '_'.
+		if !strings.HasPrefix(sf.FilePath, sfo.RemotePrefix()) {
+			continue
+		}
+		pi.DeleteSharedFile(sf)
+	}
+	pi.DB.Delete(&SyncedFile{}, "sync_folder_id = ?", sfo.ID)
+	pi.DB.Delete(sfo)
+}
+
+// RemotePrefix - where files of the folder are shared.
+func (sfo *SyncFolder) RemotePrefix() string {
+	return "/sync/" + sfo.Name + "/"
+}
+
+// SyncFolderRunner - sync all folders, forever.
+func (pi *PrivateInfoS) SyncFolderRunner() {
+	stop := pi.stop
+	for {
+		for _, sfo := range pi.GetSyncFolders() {
+			err := pi.SyncFolderNow(sfo)
+			if err != nil {
+				log.Println("Unable to sync folder:", sfo.Name, err)
+			}
+		}
+		if !pi.sleepOrStop(stop, SYNC_FOLDER_INTERVAL) {
+			return
+		}
+	}
+}
+
+// SyncFolderNow - share local changes, then pull remote ones.
+func (pi *PrivateInfoS) SyncFolderNow(sfo *SyncFolder) error {
+	if sfo.ID == 0 {
+		return errors.New("sync folder doesn't exist")
+	}
+	ui, err := pi.GetUserInfoByKeyID(sfo.DBKeyID)
+	if err == nil {
+		err = pi.scanSyncFolder(ui, sfo)
+	}
+	if err == nil {
+		err = pi.pullSyncFolder(ui, sfo)
+	}
+	sfo.LastSync = time.Now()
+	sfo.LastError = ""
+	if err != nil {
+		sfo.LastError = err.Error()
+	}
+	pi.DB.Save(sfo)
+	return err
+}
+
+func (pi *PrivateInfoS) getSyncedFile(sfo *SyncFolder, relPath string) *SyncedFile {
+	var sfi SyncedFile
+	pi.DB.First(&sfi, "sync_folder_id = ? AND rel_path = ?", sfo.ID, relPath)
+	sfi.SyncFolderID = sfo.ID
+	sfi.RelPath = relPath
+	return &sfi
+}
+
+func (pi *PrivateInfoS) getSharedFileByPath(ui *UserInfo, filePath string) *SharedFile {
+	var sf SharedFile
+	pi.DB.First(&sf, "shared_for = ? AND file_path = ?", ui.GetKeyID(), filePath)
+	return &sf
+}
+
+// scanSyncFolder - reflect local additions, changes and deletions in our
+// SharedFile rows.
+func (pi *PrivateInfoS) scanSyncFolder(ui *UserInfo, sfo *SyncFolder) error {
+	seen := make(map[string]bool)
+	err := filepath.WalkDir(sfo.LocalPath, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !de.Type().IsRegular() || strings.HasSuffix(p, ".p3psync") || isConflictCopy(p) {
+			return nil
+		}
+		rel, err := filepath.Rel(sfo.LocalPath, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+		fi, err := de.Info()
+		if err != nil {
+			return err
+		}
+		sfi := pi.getSyncedFile(sfo, rel)
+		if sfi.ID == 0 || sfi.LocalDeleted || sfi.LocalSize != fi.Size() || !sfi.LocalModTime.Equal(fi.ModTime()) {
+			sum, err := fileSha512(p)
+			if err != nil {
+				return err
+			}
+			sfi.LocalSha512Sum = sum
+			sfi.LocalSize = fi.Size()
+			sfi.LocalModTime = fi.ModTime()
+			sfi.LocalDeleted = false
+			pi.DB.Save(sfi)
+		}
+		sf := pi.getSharedFileByPath(ui, sfo.RemotePrefix()+rel)
+		if sf.Sha512Sum != sfi.LocalSha512Sum {
+			return pi.CreateFile(ui, p, sfo.RemotePrefix()+rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var sfis []*SyncedFile
+	pi.DB.Find(&sfis, "sync_folder_id = ? AND local_deleted = ?", sfo.ID, false)
+	for _, sfi := range sfis {
+		if seen[sfi.RelPath] {
+			continue
+		}
+		log.Println("Sync: deleted locally:", sfi.RelPath)
+		sf := pi.getSharedFileByPath(ui, sfo.RemotePrefix()+sfi.RelPath)
+		if sf.ID != 0 {
+			pi.DeleteSharedFile(sf)
+		}
+		sfi.LocalDeleted = true
+		pi.DB.Save(sfi)
+	}
+	return nil
+}
+
+// pullSyncFolder - mirror remote changes locally.
+func (pi *PrivateInfoS) pullSyncFolder(ui *UserInfo, sfo *SyncFolder) error {
+	remote, err := pi.GetRemoteFiles(ui)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool)
+	for _, rsf := range remote {
+		if !strings.HasPrefix(rsf.FilePath, sfo.RemotePrefix()) {
+			continue
+		}
+		rel := strings.TrimPrefix(rsf.FilePath, sfo.RemotePrefix())
+		if isConflictCopy(rel) {
+			// Shared by an older version, these are local only.
+			continue
+		}
+		target, err := localDownloadPath(sfo.LocalPath, rel)
+		if err != nil {
+			log.Println("Sync: ignoring remote file:", rsf.FilePath, err)
+			continue
+		}
+		listed[rel] = true
+		sfi := pi.getSyncedFile(sfo, rel)
+		rsum := rsf.Sha512Sum
+		if !sfi.LocalDeleted && sfi.LocalSha512Sum == rsum {
+			// Both sides have the same content.
+			sfi.SyncedSha512Sum = rsum
+			sfi.RemoteSha512Sum = rsum
+			pi.DB.Save(sfi)
+			continue
+		}
+		if sfi.RemoteSha512Sum == rsum {
+			// Remote side didn't change, our changes are shared already.
+			continue
+		}
+		localChanged := sfi.ID != 0 && !sfi.LocalDeleted && sfi.LocalSha512Sum != sfi.SyncedSha512Sum
+		if sfi.ID == 0 && fileExists(target) {
+			// Created on both sides, before scan got to it.
+			localChanged = true
+		}
+		if localChanged {
+			conflict := conflictPath(target, ui.GetKeyID())
+			log.Println("Sync: conflict, keeping remote version as:", conflict)
+			err = pi.pullSyncedFile(ui, rsf, conflict)
+			if err != nil {
+				return err
+			}
+			sfi.RemoteSha512Sum = rsum
+			pi.DB.Save(sfi)
+			continue
+		}
+		err = pi.pullSyncedFile(ui, rsf, target)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(target)
+		if err != nil {
+			return err
+		}
+		sfi.LocalSha512Sum = rsum
+		sfi.LocalSize = fi.Size()
+		sfi.LocalModTime = fi.ModTime()
+		sfi.LocalDeleted = false
+		sfi.SyncedSha512Sum = rsum
+		sfi.RemoteSha512Sum = rsum
+		pi.DB.Save(sfi)
+		err = pi.CreateFile(ui, target, rsf.FilePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	var sfis []*SyncedFile
+	pi.DB.Find(&sfis, "sync_folder_id = ? AND remote_sha512_sum != ?", sfo.ID, "")
+	for _, sfi := range sfis {
+		if listed[sfi.RelPath] {
+			continue
+		}
+		switch {
+		case sfi.LocalDeleted:
+			// Gone on both sides.
+			pi.DB.Delete(sfi)
+		case sfi.LocalSha512Sum == sfi.SyncedSha512Sum:
+			log.Println("Sync: deleted remotely:", sfi.RelPath)
+			target, err := localDownloadPath(sfo.LocalPath, sfi.RelPath)
+			if err != nil {
+				return err
+			}
+			err = os.Remove(target)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			sf := pi.getSharedFileByPath(ui, sfo.RemotePrefix()+sfi.RelPath)
+			if sf.ID != 0 {
+				pi.DeleteSharedFile(sf)
+			}
+			pi.DB.Delete(sfi)
+		default:
+			// Changed here, deleted there - our version stays.
+			sfi.RemoteSha512Sum = ""
+			pi.DB.Save(sfi)
+		}
+	}
+	return nil
+}
+
+// pullSyncedFile - download rsf next to target and put it in place once
+// it is complete, so that local file is never half-written. Partial
+// download stays there to be resumed by the next pull.
+func (pi *PrivateInfoS) pullSyncedFile(ui *UserInfo, rsf *SharedFile, target string) error {
+	tmp := target + ".p3psync"
+	d, err := pi.prepareDownloadTo(ui, rsf, tmp)
+	if err != nil {
+		return err
+	}
+	err = pi.runDownload(ui, d)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, target)
+	if err != nil {
+		return err
+	}
+	// Nothing left to resume, the file belongs to the folder now.
+	pi.DB.Unscoped().Delete(d)
+	return nil
+}
+
+// isConflictCopy - p is named by conflictPath.
+func isConflictCopy(p string) bool {
+	return strings.Contains(filepath.Base(p), ".conflict-")
+}
+
+// conflictPath - name for the remote version of target, next to it.
+func conflictPath(target string, keyid string) string {
+	ext := path.Ext(target)
+	if len(keyid) > 8 {
+		keyid = keyid[:8]
+	}
+	return fmt.Sprintf("%s.conflict-%s-%s%s", strings.TrimSuffix(target, ext), keyid, time.Now().Format("20060102T150405"), ext)
+}
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Inbound journal - bodies POSTed to us pass the inbound limits and are
+// stored in InboundEvent as they are, sender gets 202 and an ack right
+// away. InboundRunner decrypts and processes them in the background, so
+// nothing is lost when we crash mid-processing and slow processing
+// doesn't hold connections of the senders. Events that keep failing end
+// up in quarantine instead of being retried forever.
+
+const (
+	InboundStatusPending     = "pending"
+	InboundStatusQuarantined = "quarantined"
+)
+
+// INBOUND_MAX_TRIES - processing attempts before we quarantine an event.
+var INBOUND_MAX_TRIES = 10
+
+// INBOUND_RETRY_DELAY - delay after the first failed attempt, doubled
+// with every next one.
+var INBOUND_RETRY_DELAY = time.Second * 15
+
+// INBOUND_JOURNAL_MAX - events kept in the journal of an account, pending
+// and quarantined together. New requests are rejected as busy once it is
+// full.
+var INBOUND_JOURNAL_MAX int64 = 1000
+
+type InboundEvent struct {
+	gorm.Model
+	Body      []byte
+	Source    string
+	Status    string `gorm:"index"`
+	Tries     int
+	LastError string
+	NextTry   time.Time
+}
+
+func (pi *PrivateInfoS) journalInbound(body []byte, source string) *InboundEvent {
+	ievt := &InboundEvent{
+		Body:    body,
+		Source:  source,
+		Status:  InboundStatusPending,
+		NextTry: time.Now(),
+	}
+	pi.DB.Save(ievt)
+	return ievt
+}
+
+func (pi *PrivateInfoS) isInboundJournalFull() bool {
+	var count int64
+	pi.DB.Model(&InboundEvent{}).Count(&count)
+	return count >= INBOUND_JOURNAL_MAX
+}
+
+func (pi *PrivateInfoS) wakeInboundRunner() {
+	if pi.inboundWake == nil {
+		return
+	}
+	select {
+	case pi.inboundWake <- struct{}{}:
+	default:
+	}
+}
+
+// InboundRunner - process journaled events, forever.
+func (pi *PrivateInfoS) InboundRunner() {
+	stop := pi.stop
+	for {
+		pi.ProcessInbound()
+		select {
+		case <-stop:
+			return
+		case <-pi.inboundWake:
+		case <-time.After(time.Second * 5):
+		}
+	}
+}
+
+// ProcessInbound - process journaled events that are due.
+func (pi *PrivateInfoS) ProcessInbound() {
+	for {
+		var ievts []*InboundEvent
+		pi.DB.Order("id ASC").Limit(20).
+			Find(&ievts, "status = ? AND next_try <= ?", InboundStatusPending, time.Now())
+		if len(ievts) == 0 {
+			return
+		}
+		for _, ievt := range ievts {
+			pi.processInboundEvent(ievt)
+		}
+	}
+}
+
+func (pi *PrivateInfoS) processInboundEvent(ievt *InboundEvent) {
+	pi.finishInbound(ievt, pi.tryProcessInbound(ievt.Body))
+}
+
+// finishInbound - drop ievt if err is nil, otherwise schedule the next
+// try, or quarantine it.
+func (pi *PrivateInfoS) finishInbound(ievt *InboundEvent, err error) {
+	if err == nil {
+		pi.DB.Unscoped().Delete(ievt)
+		return
+	}
+	ievt.Tries++
+	ievt.LastError = err.Error()
+	ievt.NextTry = time.Now().Add(INBOUND_RETRY_DELAY * time.Duration(1<<min(ievt.Tries-1, 16)))
+	if ievt.Tries >= INBOUND_MAX_TRIES {
+		log.Println("Quarantining inbound event", ievt.ID, "after", ievt.Tries, "tries:", err)
+		ievt.Status = InboundStatusQuarantined
+	} else {
+		log.Println("Unable to process inbound event", ievt.ID, "try", ievt.Tries, err)
+	}
+	pi.DB.Save(ievt)
+}
+
+func (pi *PrivateInfoS) tryProcessInbound(body []byte) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("panic: %v", rec)
+		}
+	}()
+	evts := processString(pi, string(body), "UnKnoWn")
+	if len(evts) == 0 {
+		return errors.New("unable to decode any event")
+	}
+	return pi.processEvents(evts)
+}
+
+// processEvents - TryProcess all evts, stopping at the first error.
+func (pi *PrivateInfoS) processEvents(evts []Event) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("panic: %v", rec)
+		}
+	}()
+	for i := range evts {
+		err := evts[i].TryProcess(pi)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pi *PrivateInfoS) GetQuarantinedInboundEvents() (ievts []*InboundEvent) {
+	pi.DB.Find(&ievts, "status = ?", InboundStatusQuarantined)
+	return ievts
+}
+
+func (pi *PrivateInfoS) GetInboundEventByID(id uint) *InboundEvent {
+	var ievt InboundEvent
+	pi.DB.First(&ievt, "id = ?", id)
+	return &ievt
+}
+
+// RetryInboundEvent - take event out of quarantine.
+func (pi *PrivateInfoS) RetryInboundEvent(ievt *InboundEvent) {
+	if ievt.ID == 0 {
+		return
+	}
+	ievt.Status = InboundStatusPending
+	ievt.Tries = 0
+	ievt.NextTry = time.Now()
+	pi.DB.Save(ievt)
+	pi.wakeInboundRunner()
+}
+
+func (pi *PrivateInfoS) DeleteInboundEvent(ievt *InboundEvent) {
+	pi.DB.Unscoped().Delete(ievt)
+}
@@ -0,0 +1,172 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Anyone who knows an endpoint is able to POST to it, these limits make
+// sure that they can't exhaust our memory or CPU while doing so.
+
+// INBOUND_MAX_BODY_SIZE - biggest body that we accept.
+var INBOUND_MAX_BODY_SIZE int64 = 8 * 1024 * 1024
+
+// INBOUND_SOURCE_RATE, INBOUND_SOURCE_BURST - requests per second that
+// a single source is allowed to make.
+var INBOUND_SOURCE_RATE = 2.0
+var INBOUND_SOURCE_BURST = 30.0
+
+// INBOUND_ACCOUNT_RATE, INBOUND_ACCOUNT_BURST - requests per second that
+// a single account accepts, from all sources together.
+var INBOUND_ACCOUNT_RATE = 10.0
+var INBOUND_ACCOUNT_BURST = 100.0
+
+const (
+	inboundRejectTooLarge   = "too_large"
+	inboundRejectRateSource = "rate_source"
+	inboundRejectRateAcct   = "rate_account"
+	inboundRejectMalformed  = "malformed"
+	inboundRejectBusy       = "busy"
+	inboundRejectUnknown    = "unknown_account"
+	inboundRejectStamp      = "insufficient_work"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	lock    sync.Mutex
+	rate    *float64
+	burst   *float64
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate *float64, burst *float64) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+func (rl *rateLimiter) Allow(key string) bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	now := time.Now()
+	b, ok := rl.buckets[key]
+	if !ok {
+		if len(rl.buckets) > 10000 {
+			rl.prune(now)
+		}
+		b = &tokenBucket{tokens: *rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * *rl.rate
+	if b.tokens > *rl.burst {
+		b.tokens = *rl.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune - forget buckets that are full again anyway.
+func (rl *rateLimiter) prune(now time.Time) {
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()**rl.rate >= *rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// inboundSource - who is sending the request. i2pd server tunnels tell
+// us the destination of the client, otherwise all we have is the address
+// of the proxy. Anyone can set the header, so it only counts when the
+// request comes from I2PTunnelHost.
+func (ls *LocalServer) inboundSource(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	if dest := r.Header.Get("X-I2P-DestB32"); dest != "" && ls.I2PTunnelHost != "" && host == ls.I2PTunnelHost {
+		return dest
+	}
+	return host
+}
+
+// looksLikeEvent - PGP armor or JSON, anything else is not worth the
+// decryption attempt.
+func looksLikeEvent(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return false
+	}
+	if b[0] == '{' || b[0] == '[' {
+		return true
+	}
+	return bytes.HasPrefix(b, []byte("-----BEGIN PGP MESSAGE-----"))
+}
+
+func (ls *LocalServer) inboundReject(w http.ResponseWriter, account string, reason string, status int, err error) {
+	ls.metricsInboundRejection(account, reason)
+	log.Println("Rejected inbound request:", account, reason, err)
+	w.WriteHeader(status)
+	_, err = w.Write([]byte(err.Error()))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// allowInbound - apply rate limits, false is returned if the request was
+// rejected (and response was already sent).
+func (ls *LocalServer) allowInbound(w http.ResponseWriter, r *http.Request, account string) bool {
+	if !ls.sourceLimiter.Allow(ls.inboundSource(r)) {
+		ls.inboundReject(w, account, inboundRejectRateSource, http.StatusTooManyRequests, errors.New("too many requests"))
+		return false
+	}
+	if !ls.accountLimiter.Allow(account) {
+		ls.inboundReject(w, account, inboundRejectRateAcct, http.StatusTooManyRequests, errors.New("too many requests"))
+		return false
+	}
+	return true
+}
+
+// readInbound - read body of the request, nil is returned if the request
+// was rejected (and response was already sent).
+func (ls *LocalServer) readInbound(w http.ResponseWriter, r *http.Request, account string) []byte {
+	if r.ContentLength > INBOUND_MAX_BODY_SIZE {
+		ls.inboundReject(w, account, inboundRejectTooLarge, http.StatusRequestEntityTooLarge, errors.New("body is too large"))
+		return nil
+	}
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, INBOUND_MAX_BODY_SIZE))
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			ls.inboundReject(w, account, inboundRejectTooLarge, http.StatusRequestEntityTooLarge, errors.New("body is too large"))
+			return nil
+		}
+		log.Println("[WARN]: Unable to read:", err)
+		w.WriteHeader(500)
+		_, err := w.Write([]byte("Internal server error"))
+		if err != nil {
+			log.Println(err)
+		}
+		return nil
+	}
+	if len(b) == 0 && r.Header.Get(outboxHeader) != "" {
+		// Asking for our outbox, see helloOutboxes.
+		return b
+	}
+	if !looksLikeEvent(b) {
+		ls.inboundReject(w, account, inboundRejectMalformed, http.StatusBadRequest, errors.New("body is neither PGP message nor JSON"))
+		return nil
+	}
+	return b
+}
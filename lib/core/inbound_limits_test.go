@@ -0,0 +1,98 @@
+package core
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rate, burst := 0.0, 3.0
+	rl := newRateLimiter(&rate, &burst)
+	for i := 0; i < 3; i++ {
+		if !rl.Allow("a") {
+			t.Fatal("request", i, "should be allowed")
+		}
+	}
+	if rl.Allow("a") {
+		t.Fatal("request over the burst was allowed")
+	}
+	if !rl.Allow("b") {
+		t.Fatal("sources should have their own buckets")
+	}
+	rate = 1000
+	time.Sleep(10 * time.Millisecond)
+	if !rl.Allow("a") {
+		t.Fatal("bucket should refill")
+	}
+}
+
+func TestInboundSource(t *testing.T) {
+	ls := NewLocalServer("127.0.0.1", 0)
+	r := httptest.NewRequest("POST", "/alice", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-I2P-DestB32", "dest.b32.i2p")
+	if src := ls.inboundSource(r); src != "10.0.0.1" {
+		t.Fatal("header trusted without I2PTunnelHost:", src)
+	}
+	ls.I2PTunnelHost = "10.0.0.2"
+	if src := ls.inboundSource(r); src != "10.0.0.1" {
+		t.Fatal("header trusted from another host:", src)
+	}
+	ls.I2PTunnelHost = "10.0.0.1"
+	if src := ls.inboundSource(r); src != "dest.b32.i2p" {
+		t.Fatal("header not trusted from I2PTunnelHost:", src)
+	}
+}
+
+func TestLooksLikeEvent(t *testing.T) {
+	tests := []struct {
+		body string
+		ok   bool
+	}{
+		{`{"type":"message"}`, true},
+		{` [{"type":"message"}]`, true},
+		{"-----BEGIN PGP MESSAGE-----\n", true},
+		{"", false},
+		{"GET / HTTP/1.1", false},
+		{"-----BEGIN PGP SIGNATURE-----\n", false},
+	}
+	for _, tt := range tests {
+		if looksLikeEvent([]byte(tt.body)) != tt.ok {
+			t.Errorf("looksLikeEvent(%q) != %v", tt.body, tt.ok)
+		}
+	}
+}
+
+func TestInboundRejected(t *testing.T) {
+	ls := startTestServer(t)
+	openTestAccount(t, ls, "alice")
+	defer func(size int64) { INBOUND_MAX_BODY_SIZE = size }(INBOUND_MAX_BODY_SIZE)
+	INBOUND_MAX_BODY_SIZE = 1024
+
+	tests := []struct {
+		name   string
+		path   string
+		body   []byte
+		status int
+	}{
+		{"malformed", "/alice", []byte("hello"), http.StatusBadRequest},
+		{"too large", "/alice", []byte("{" + strings.Repeat(" ", 2048) + "}"), http.StatusRequestEntityTooLarge},
+		{"unknown account", "/bob", []byte("{}"), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post("http://"+ls.Addr()+tt.path, "application/octet-stream", bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatal("status", resp.StatusCode, "want", tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+)
+
+// introduce.request - ask somebody that we only know the endpoint of to
+// add us. We fetch their key from discovery and send them our key,
+// signed by itself; they reply with an introduce once they accept us
+// (right away if token is one of their valid invite tokens).
+
+// RequestIntroduction - add user behind endpoint and ask them to add us
+// back, token is optional.
+func (pi *PrivateInfoS) RequestIntroduction(endpoint Endpoint, token string) (*UserInfo, error) {
+	if pi.Endpoint == "" {
+		return nil, errors.New("we have no endpoint to be introduced at")
+	}
+	dui, err := DiscoverUserByURLPinned(endpoint.GetHost(), token, pi.knownFingerprint(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	ui, err := pi.saveUserByPublicKey(dui.PublicKey, dui.Name, endpoint, UserInfoStateAccepted)
+	if err != nil {
+		return nil, err
+	}
+	ui.SetEndpoints(append([]Endpoint{endpoint}, dui.Endpoints...))
+	ui.StampBits = dui.StampBits
+	// Kept until they introduce themselves, the request may have to be
+	// built again before it is delivered.
+	ui.InviteToken = token
+	pi.DB.Save(ui)
+	// Stamp (if any) is minted by the relay, not here.
+	err = QueueEvent(pi, pi.introduceRequestEvent(ui), ui)
+	if err != nil {
+		return nil, err
+	}
+	return ui, nil
+}
+
+// introduceRequestEvent - introduce.request for ui, without a stamp.
+func (pi *PrivateInfoS) introduceRequestEvent(ui *UserInfo) Event {
+	return Event{
+		EventType: EventTypeIntroduceRequest,
+		Data: EventDataMixed{
+			EventDataIntroduceRequest: EventDataIntroduceRequest{
+				SelfPublicKey: pi.PublicKey,
+				SelfUsername:  pi.Username,
+				Endpoint:      pi.Endpoint,
+				Token:         ui.InviteToken,
+			},
+		},
+	}
+}
+
+// verifyIntroduceRequest - plaintext decrypted from ciphertext failed
+// signature check against our contacts, if it is an introduce.request
+// signed by the key it carries return that key's fingerprint.
+func verifyIntroduceRequest(privateKeyRing *crypto.KeyRing, ciphertext *crypto.PGPMessage, plaintext string) string {
+	inner, isEnvelope, err := openEnvelope(plaintext)
+	if isEnvelope {
+		if err != nil {
+			return ""
+		}
+		plaintext = inner
+	}
+	var evt Event
+	err = json.Unmarshal([]byte(plaintext), &evt)
+	if err != nil || evt.EventType != EventTypeIntroduceRequest {
+		return ""
+	}
+	publicKey, err := crypto.NewKeyFromArmored(evt.Data.SelfPublicKey)
+	if err != nil {
+		log.Println("introduce.request with invalid key:", err)
+		return ""
+	}
+	keyRing, err := crypto.NewKeyRing(publicKey)
+	if err != nil {
+		return ""
+	}
+	_, err = privateKeyRing.Decrypt(ciphertext, keyRing, 0)
+	if err != nil {
+		log.Println("introduce.request signature doesn't match its key:", err)
+		return ""
+	}
+	return publicKey.GetFingerprint()
+}
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// startTestServer - LocalServer on a random loopback port, reaching the
+// local:// endpoints directly.
+func startTestServer(t *testing.T) *LocalServer {
+	t.Helper()
+	LOCAL_ENDPOINTS_DIRECT = true
+	I2P_HTTP_PROXY = "http://127.0.0.1:1"
+	ls := NewLocalServer("127.0.0.1", 0)
+	if err := ls.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ls.Shutdown(context.Background())
+		LOCAL_ENDPOINTS_DIRECT = false
+	})
+	return ls
+}
+
+// openTestAccount - created account that is served by ls under path.
+func openTestAccount(t *testing.T, ls *LocalServer, name string) *PrivateInfoS {
+	t.Helper()
+	pi := OpenPrivateInfo(t.TempDir(), name, name, false)
+	if err := pi.Create(name, name+"@localhost", 1024); err != nil {
+		t.Fatal(err)
+	}
+	pi.Endpoint = Endpoint("local://" + ls.Addr() + "/" + name)
+	pi.DB.Save(pi)
+	ls.Accounts.Register(name, pi)
+	t.Cleanup(func() { ClosePrivateInfo(pi) })
+	return pi
+}
+
+// waitFor - poll cond until it is true, fail the test after 30 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func isContact(pi *PrivateInfoS, keyid string) bool {
+	ui, err := pi.GetUserInfoByKeyID(keyid)
+	return err == nil && ui.State == UserInfoStateAccepted
+}
+
+func TestRequestIntroductionWithInvite(t *testing.T) {
+	ls := startTestServer(t)
+	alice := openTestAccount(t, ls, "alice")
+	bob := openTestAccount(t, ls, "bob")
+
+	it, err := alice.CreateInviteToken(1, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ui, err := bob.RequestIntroduction(alice.Endpoint, it.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ui.State != UserInfoStateAccepted {
+		t.Fatal("requester should accept alice right away, got", ui.State)
+	}
+
+	waitFor(t, "alice to accept bob", func() bool {
+		return isContact(alice, bob.GetKeyID())
+	})
+	waitFor(t, "introduce reply with files metadata", func() bool {
+		return len(ui.GetReceivedSharedFilesMetadataIDs(bob)) != 0
+	})
+	if !isContact(bob, alice.GetKeyID()) {
+		t.Fatal("bob should still have alice as a contact")
+	}
+}
+
+func TestRequestIntroductionPending(t *testing.T) {
+	ls := startTestServer(t)
+	alice := openTestAccount(t, ls, "alice")
+	bob := openTestAccount(t, ls, "bob")
+
+	ui, err := bob.RequestIntroduction(alice.Endpoint, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pending []*UserInfo
+	waitFor(t, "bob to be pending at alice", func() bool {
+		pending = alice.GetUserInfoByState(UserInfoStatePending)
+		return len(pending) == 1
+	})
+	if pending[0].Username != "bob" {
+		t.Fatal("unexpected pending contact", pending[0].Username)
+	}
+	if len(ui.GetReceivedSharedFilesMetadataIDs(bob)) != 0 {
+		t.Fatal("files metadata was sent before the request got accepted")
+	}
+	if err := alice.AcceptUserInfo(pending[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "introduce reply with files metadata", func() bool {
+		return len(ui.GetReceivedSharedFilesMetadataIDs(bob)) != 0
+	})
+	if !isContact(alice, bob.GetKeyID()) || !isContact(bob, alice.GetKeyID()) {
+		t.Fatal("both sides should be contacts")
+	}
+}
+
+func TestRequestIntroductionPendingWithInvite(t *testing.T) {
+	ls := startTestServer(t)
+	alice := openTestAccount(t, ls, "alice")
+	bob := openTestAccount(t, ls, "bob")
+
+	_, err := bob.RequestIntroduction(alice.Endpoint, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "bob to be pending at alice", func() bool {
+		return len(alice.GetUserInfoByState(UserInfoStatePending)) == 1
+	})
+
+	it, err := alice.CreateInviteToken(1, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ui, err := bob.RequestIntroduction(alice.Endpoint, it.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "alice to accept bob", func() bool {
+		return isContact(alice, bob.GetKeyID())
+	})
+	waitFor(t, "introduce reply with files metadata", func() bool {
+		return len(ui.GetReceivedSharedFilesMetadataIDs(bob)) != 0
+	})
+	var used InviteToken
+	alice.DB.First(&used, it.ID)
+	if used.Uses != 1 {
+		t.Fatal("invite should be used once, got", used.Uses)
+	}
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/ProtonMail/gopenpgp/v2/helper"
+)
+
+// Introduce events travel unencrypted, so anyone could send one carrying
+// somebody else's key. Sender cleartext signs the introduce with the key
+// it carries (proving that it holds the private part), for a single
+// recipient and with a timestamp so that it can't be replayed later.
+// Clients that predate signing send plain introduces, these are only
+// good enough for a pending request from a stranger - see
+// tryProcessIntroduce.
+
+// IntroduceMaxAge - signed introduces older than that are rejected.
+var IntroduceMaxAge = time.Hour * 48
+
+// errIntroduceNotSigned - introduce from a client that doesn't sign them.
+var errIntroduceNotSigned = errors.New("introduce is not signed")
+
+// signIntroduce - armored cleartext signed copy of intro.
+func (pi *PrivateInfoS) signIntroduce(intro EventDataIntroduce) (string, error) {
+	intro.Signed = ""
+	intro.Timestamp = time.Now().Unix()
+	b, err := json.Marshal(intro)
+	if err != nil {
+		return "", err
+	}
+	return helper.SignCleartextMessageArmored(pi.PrivateKey, pi.Passphrase, string(b))
+}
+
+// verifyIntroduce - signed copy of intro, if it is signed by the key it
+// carries and addressed to us.
+func (pi *PrivateInfoS) verifyIntroduce(intro EventDataIntroduce) (EventDataIntroduce, error) {
+	if intro.Signed == "" {
+		return EventDataIntroduce{}, errIntroduceNotSigned
+	}
+	msg, err := crypto.NewClearTextMessageFromArmored(intro.Signed)
+	if err != nil {
+		return EventDataIntroduce{}, err
+	}
+	// Same as with discovery, the key is inside of what we verify.
+	var unverified EventDataIntroduce
+	err = json.Unmarshal(msg.GetBinary(), &unverified)
+	if err != nil {
+		return EventDataIntroduce{}, err
+	}
+	text, err := helper.VerifyCleartextMessageArmored(unverified.PublicKey, intro.Signed, crypto.GetUnixTime())
+	if err != nil {
+		return EventDataIntroduce{}, err
+	}
+	var signed EventDataIntroduce
+	err = json.Unmarshal([]byte(text), &signed)
+	if err != nil {
+		return EventDataIntroduce{}, err
+	}
+	if !strings.EqualFold(signed.Recipient, pi.GetFingerprint()) {
+		return EventDataIntroduce{}, errors.New("introduce is addressed to somebody else")
+	}
+	if time.Unix(signed.Timestamp, 0).After(time.Now().Add(DiscoveryMaxClockSkew)) {
+		return EventDataIntroduce{}, errors.New("introduce is from the future")
+	}
+	if time.Since(time.Unix(signed.Timestamp, 0)) > IntroduceMaxAge {
+		return EventDataIntroduce{}, errors.New("introduce is too old")
+	}
+	return signed, nil
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyIntroduce(t *testing.T) {
+	alice := createTestAccount(t, "alice")
+	bob := createTestAccount(t, "bob")
+	intro := EventDataIntroduce{
+		PublicKey: alice.PublicKey,
+		Username:  "alice",
+		Recipient: bob.GetFingerprint(),
+	}
+	signed, err := alice.signIntroduce(intro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intro.Signed = signed
+	got, err := bob.verifyIntroduce(intro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Username != "alice" || got.PublicKey != alice.PublicKey {
+		t.Fatal("unexpected introduce", got)
+	}
+}
+
+func TestVerifyIntroduceRejected(t *testing.T) {
+	alice := createTestAccount(t, "alice")
+	bob := createTestAccount(t, "bob")
+	mallory := createTestAccount(t, "mallory")
+	intro := EventDataIntroduce{
+		PublicKey: alice.PublicKey,
+		Username:  "alice",
+		Recipient: bob.GetFingerprint(),
+	}
+
+	if _, err := bob.verifyIntroduce(intro); err != errIntroduceNotSigned {
+		t.Fatal("expected errIntroduceNotSigned, got", err)
+	}
+	// mallory is not able to sign for alice's key.
+	forged, err := mallory.signIntroduce(intro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.verifyIntroduce(EventDataIntroduce{Signed: forged}); err == nil {
+		t.Fatal("introduce signed by another key was accepted")
+	}
+
+	signed, err := alice.signIntroduce(intro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mallory.verifyIntroduce(EventDataIntroduce{Signed: signed}); err == nil {
+		t.Fatal("introduce addressed to bob was accepted by mallory")
+	}
+	tampered := strings.Replace(signed, `"username":"alice"`, `"username":"mallory"`, 1)
+	if tampered == signed {
+		t.Fatal("username not found in the signed introduce")
+	}
+	if _, err := bob.verifyIntroduce(EventDataIntroduce{Signed: tampered}); err == nil {
+		t.Fatal("tampered introduce was accepted")
+	}
+
+	defer func(age time.Duration) { IntroduceMaxAge = age }(IntroduceMaxAge)
+	IntroduceMaxAge = -time.Minute
+	if _, err := bob.verifyIntroduce(EventDataIntroduce{Signed: signed}); err == nil {
+		t.Fatal("replayed introduce was accepted")
+	}
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+
+	"git.mrcyjanek.net/p3pch4t/p3pgo/lib/qrcode"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+)
+
+// Invite - what we need to add someone as a contact, encoded as
+//
+//	p3p://invite?fp=<fingerprint>&e=<endpoint>&e=<endpoint>&t=<token>&n=<username>
+//
+// The public key itself is too big for a QR code, so it is fetched from
+// discovery and checked against the fingerprint.
+type Invite struct {
+	Fingerprint string
+	Endpoints   []Endpoint
+	// Token - optional, presented in discovery and introduce.
+	Token    string
+	Username string
+}
+
+const InviteScheme = "p3p"
+
+func (inv *Invite) String() string {
+	q := url.Values{}
+	q.Set("fp", inv.Fingerprint)
+	for _, endpoint := range inv.Endpoints {
+		q.Add("e", string(endpoint))
+	}
+	if inv.Token != "" {
+		q.Set("t", inv.Token)
+	}
+	if inv.Username != "" {
+		q.Set("n", inv.Username)
+	}
+	return InviteScheme + "://invite?" + q.Encode()
+}
+
+func ParseInvite(uri string) (*Invite, error) {
+	u, err := url.Parse(strings.TrimSpace(uri))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != InviteScheme || u.Host != "invite" {
+		return nil, errors.New("not a p3p:// invite")
+	}
+	q := u.Query()
+	inv := &Invite{
+		Fingerprint: strings.ToLower(q.Get("fp")),
+		Token:       q.Get("t"),
+		Username:    q.Get("n"),
+	}
+	for _, endpoint := range q["e"] {
+		inv.Endpoints = append(inv.Endpoints, Endpoint(endpoint))
+	}
+	if inv.Fingerprint == "" || len(inv.Endpoints) == 0 {
+		return nil, errors.New("invite is missing fingerprint or endpoints")
+	}
+	return inv, nil
+}
+
+// QRCodePNG - invite as QR code, each module scale pixels wide.
+func (inv *Invite) QRCodePNG(scale int) ([]byte, error) {
+	code, err := qrcode.Encode([]byte(inv.String()), qrcode.Medium)
+	if err != nil {
+		return nil, err
+	}
+	return code.PNG(scale)
+}
+
+func (inv *Invite) QRCodeSVG(scale int) (string, error) {
+	code, err := qrcode.Encode([]byte(inv.String()), qrcode.Medium)
+	if err != nil {
+		return "", err
+	}
+	return code.SVG(scale), nil
+}
+
+// GetInvite - invite to our account, token may be empty.
+func (pi *PrivateInfoS) GetInvite(token string) *Invite {
+	inv := &Invite{
+		Fingerprint: pi.GetFingerprint(),
+		Endpoints:   pi.GetEndpoints(),
+		Token:       token,
+	}
+	if !pi.DiscoveryHideProfile {
+		inv.Username = pi.Username
+	}
+	return inv
+}
+
+func (pi *PrivateInfoS) GetFingerprint() string {
+	publicKey, err := crypto.NewKeyFromArmored(pi.PublicKey)
+	if err != nil {
+		log.Panicln("unable to GetFingerprint on PI")
+		return ""
+	}
+	return strings.ToLower(publicKey.GetFingerprint())
+}
+
+// AcceptInvite - fetch the key of invite's author, add them as a contact
+// and introduce ourselves.
+func (pi *PrivateInfoS) AcceptInvite(uri string) (*UserInfo, error) {
+	inv, err := ParseInvite(uri)
+	if err != nil {
+		return nil, err
+	}
+	var dui DiscoveredUserInfo
+	for _, endpoint := range inv.Endpoints {
+		dui, err = DiscoverUserByURLPinned(endpoint.GetHost(), inv.Token, inv.Fingerprint)
+		if err == nil {
+			break
+		}
+		log.Println("Unable to discover", endpoint, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(dui.Fingerprint, inv.Fingerprint) {
+		return nil, errors.New("invite fingerprint doesn't match the discovered key")
+	}
+	username := dui.Name
+	if username == "" {
+		username = inv.Username
+	}
+	ui, err := pi.CreateUserByPublicKey(dui.PublicKey, username, inv.Endpoints[0], false)
+	if err != nil {
+		return nil, err
+	}
+	ui.SetEndpoints(mergeEndpoints(append(inv.Endpoints, dui.Endpoints...)))
+	ui.InviteToken = inv.Token
+	ui.StampBits = dui.StampBits
+	pi.DB.Save(ui)
+	ui.SendIntroduceEvent(pi)
+	return ui, nil
+}
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Invite tokens - handed out in invites (see GetInvite), they let the
+// holder discover us and get an introduce.request accepted without our
+// approval. Tokens can expire, be limited to a number of uses and be
+// revoked, every use is recorded in InviteTokenUse.
+
+// InviteToken - token issued by us.
+type InviteToken struct {
+	gorm.Model
+	Token string `gorm:"uniqueIndex"`
+	// Note - where the token was published, for the user only.
+	Note string
+	// ExpiresAt - zero means that the token never expires.
+	ExpiresAt time.Time
+	// MaxUses - 0 means unlimited.
+	MaxUses int
+	Uses    int
+	Revoked bool
+}
+
+// InviteTokenUse - contact that has presented InviteToken.
+type InviteTokenUse struct {
+	gorm.Model
+	InviteTokenID uint `gorm:"index"`
+	KeyID         string
+	Endpoint      Endpoint
+}
+
+// CreateInviteToken - issue new token, valid for maxUses contacts (0 for
+// unlimited) and ttl (0 for forever).
+func (pi *PrivateInfoS) CreateInviteToken(maxUses int, ttl time.Duration, note string) (*InviteToken, error) {
+	token, err := GenerateRandomStringURLSafe(32)
+	if err != nil {
+		return nil, err
+	}
+	it := &InviteToken{
+		Token:   token,
+		Note:    note,
+		MaxUses: maxUses,
+	}
+	if ttl > 0 {
+		it.ExpiresAt = time.Now().Add(ttl)
+	}
+	pi.DB.Save(it)
+	return it, nil
+}
+
+func (pi *PrivateInfoS) GetInviteTokens() (its []*InviteToken) {
+	pi.DB.Order("id").Find(&its)
+	return its
+}
+
+func (pi *PrivateInfoS) GetInviteTokenByID(id uint) *InviteToken {
+	var it InviteToken
+	pi.DB.First(&it, "id = ?", id)
+	return &it
+}
+
+func (pi *PrivateInfoS) RevokeInviteToken(it *InviteToken) {
+	it.Revoked = true
+	pi.DB.Save(it)
+}
+
+// GetInviteTokenUses - usage history of the token, oldest first.
+func (pi *PrivateInfoS) GetInviteTokenUses(it *InviteToken) (uses []*InviteTokenUse) {
+	pi.DB.Order("id").Find(&uses, "invite_token_id = ?", it.ID)
+	return uses
+}
+
+// IsValid - token is neither revoked, expired nor used up.
+func (it *InviteToken) IsValid() bool {
+	if it.ID == 0 || it.Revoked {
+		return false
+	}
+	if !it.ExpiresAt.IsZero() && time.Now().After(it.ExpiresAt) {
+		return false
+	}
+	return it.MaxUses == 0 || it.Uses < it.MaxUses
+}
+
+// findValidInviteToken - InviteToken matching token, nil if there is no
+// such token or it is not valid anymore.
+func (pi *PrivateInfoS) findValidInviteToken(token string) *InviteToken {
+	token = strings.TrimPrefix(token, "Bearer ")
+	if token == "" {
+		return nil
+	}
+	var it InviteToken
+	pi.DB.First(&it, "token = ?", token)
+	if it.Token != token || !it.IsValid() {
+		return nil
+	}
+	return &it
+}
+
+// useInviteToken - record use of the token by keyid. Contact presenting
+// a token it has already used doesn't count as another use, so that
+// retried introductions don't exhaust one-time tokens.
+func (pi *PrivateInfoS) useInviteToken(token string, keyid string, endpoint Endpoint) bool {
+	token = strings.TrimPrefix(token, "Bearer ")
+	if token == "" {
+		return false
+	}
+	var it InviteToken
+	pi.DB.First(&it, "token = ?", token)
+	if it.Token != token {
+		return false
+	}
+	var count int64
+	pi.DB.Model(&InviteTokenUse{}).Where("invite_token_id = ? AND key_id = ?", it.ID, keyid).Count(&count)
+	if count != 0 {
+		return !it.Revoked
+	}
+	if !it.IsValid() {
+		log.Println("Invite token is no longer valid:", it.ID)
+		return false
+	}
+	it.Uses++
+	pi.DB.Save(&it)
+	pi.DB.Save(&InviteTokenUse{
+		InviteTokenID: it.ID,
+		KeyID:         keyid,
+		Endpoint:      endpoint,
+	})
+	return true
+}
+
+// acceptByInvite - promote pending or rejected ui to accepted when they
+// present a valid invite token. The token is only used when it changes
+// their state, blocked and accepted contacts don't use it up.
+func (pi *PrivateInfoS) acceptByInvite(ui *UserInfo, token string, keyid string, endpoint Endpoint) bool {
+	if ui.State != UserInfoStatePending && ui.State != UserInfoStateRejected {
+		return false
+	}
+	if !pi.useInviteToken(token, keyid, endpoint) {
+		return false
+	}
+	ui.State = UserInfoStateAccepted
+	return true
+}
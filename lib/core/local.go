@@ -6,46 +6,16 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"strconv"
 	"strings"
-
-	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
 )
 
 func init() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 }
 
-var r *chi.Mux
-
-var IsLocalServerRunning = false
-
-var LOCAL_SERVER_PORT = 3893
-
-func StartLocalServer() {
-	if IsLocalServerRunning {
-		return
-	}
-	IsLocalServerRunning = true
-	r = chi.NewRouter()
-	r.Use(middleware.Logger)
-	r.Get("/files.http/{sharedFor}/*", FileServe)
-	r.Get("/", getHandleGet())
-	r.Post("/", getHandlePost())
-	r.Get("/*", getHandleGet())
-	r.Post("/*", getHandlePost())
-	go func() {
-		localServerPort := strconv.Itoa(LOCAL_SERVER_PORT)
-		log.Println("starting on :" + localServerPort)
-		err := http.ListenAndServe(":"+localServerPort, r)
-		if err != nil {
-			log.Fatalln(err)
-		}
-	}()
-}
-
-func getPrivateInfoByPath(path string) (pi *PrivateInfoS, pathpart string, err error) {
+// byRequestPath - account that path belongs to. Returned account is in
+// use, release it when you are done.
+func (ar *AccountRegistry) byRequestPath(path string) (pi *PrivateInfoS, pathpart string, err error) {
 	if len(path) == 0 {
 		path = "/"
 	}
@@ -58,7 +28,7 @@ func getPrivateInfoByPath(path string) (pi *PrivateInfoS, pathpart string, err e
 		path = path[0:]
 	}
 	log.Println("path:", path)
-	pi, ok := privateInfoMap[path]
+	pi, ok := ar.usingPath(path)
 	if !ok {
 		return &PrivateInfoS{}, path, errors.New("unable to find requested path")
 	}
@@ -66,30 +36,39 @@ func getPrivateInfoByPath(path string) (pi *PrivateInfoS, pathpart string, err e
 	return pi, path, nil
 }
 
-func getHandleGet() func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println("GET", r.RequestURI)
-		pi, pathpart, err := getPrivateInfoByPath(r.RequestURI)
+func (ls *LocalServer) handleGet(w http.ResponseWriter, r *http.Request) {
+	log.Println("GET", r.RequestURI)
+	pi, pathpart, err := ls.Accounts.byRequestPath(r.RequestURI)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		_, err := w.Write([]byte(err.Error()))
 		if err != nil {
 			log.Println(err)
-			w.WriteHeader(500)
-			_, err := w.Write([]byte(err.Error()))
-			if err != nil {
-				log.Println(err)
-			}
-			return
 		}
-		log.Println(pathpart, r.RequestURI)
-		// Are we looking for a file?
-		// we are not looking for a file
+		return
+	}
+	defer pi.release()
+	log.Println(pathpart, r.RequestURI)
+	// Are we looking for a file?
+	// we are not looking for a file
 
-		processDiscovery(pi, w, r)
+	processDiscovery(pi, w, r)
 
-	}
 }
 
 func processDiscovery(pi *PrivateInfoS, w http.ResponseWriter, r *http.Request) {
-	b, err := json.Marshal(pi.GetDiscoveredUserInfo())
+	dui, ok := pi.discoveryFor(r.Header.Get("Authentication"))
+	if !ok {
+		// Same as an unknown path, so nobody can tell that we exist.
+		w.WriteHeader(http.StatusNotFound)
+		_, err := w.Write([]byte("unable to find requested path"))
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	b, err := pi.signDiscovery(dui)
 	if err != nil {
 		w.WriteHeader(500)
 		_, err := w.Write([]byte("an error occurred, and response couldn't get generated."))
@@ -104,73 +83,87 @@ func processDiscovery(pi *PrivateInfoS, w http.ResponseWriter, r *http.Request)
 	}
 }
 
-func getHandlePost() func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		pi, _, err := getPrivateInfoByPath(r.RequestURI)
+func (ls *LocalServer) handlePost(w http.ResponseWriter, r *http.Request) {
+	pi, _, err := ls.Accounts.byRequestPath(r.RequestURI)
+	if err != nil {
+		ls.inboundReject(w, metricsDefaultAccountName, inboundRejectUnknown, http.StatusNotFound, err)
+		return
+	}
+	defer pi.release()
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
 		if err != nil {
-			_, err := w.Write([]byte(err.Error()))
-			if err != nil {
-				log.Println(err)
-			}
-			return
+			log.Println(err)
 		}
-		b, err := io.ReadAll(r.Body)
-		defer func(Body io.ReadCloser) {
-			err := Body.Close()
-			if err != nil {
-				log.Println(err)
-			}
-		}(r.Body)
-		if err != nil && err != io.EOF {
-			log.Println("[WARN]: Unable to read:", err)
-			w.WriteHeader(500)
-			_, err := w.Write([]byte("Internal server error"))
-			if err != nil {
-				log.Println(err)
-			}
+	}(r.Body)
+	if !ls.allowInbound(w, r, pi.metricsAccount()) {
+		return
+	}
+	b := ls.readInbound(w, r, pi.metricsAccount())
+	if b == nil {
+		return
+	}
+	ack := DeliveryAck{Uuids: []string{}, Outbox: pi.outboxFor(r.Header.Get(outboxHeader))}
+	status := http.StatusOK
+	if len(b) != 0 {
+		if !pi.checkStampBody(b) {
+			ls.inboundReject(w, pi.metricsAccount(), inboundRejectStamp, http.StatusForbidden, errors.New("not enough proof of work"))
 			return
 		}
-		log.Println("processString")
-		evts := processString(pi, string(b), "UnKnoWn")
-		for i := range evts {
-			evts[i].TryProcess(pi)
+		if !pi.isEncryptedForUs(string(b)) {
+			ack.KeyMismatch = true
+		} else {
+			if pi.isInboundJournalFull() {
+				ls.inboundReject(w, pi.metricsAccount(), inboundRejectBusy, http.StatusServiceUnavailable, errors.New("inbound journal is full"))
+				return
+			}
+			// Decrypted and processed by InboundRunner, sender can drop
+			// the event once it sees the body in the ack.
+			pi.journalInbound(b, ls.inboundSource(r))
+			pi.wakeInboundRunner()
+			ack.Bodies = []string{sha256Hex(b)}
+			status = http.StatusAccepted
 		}
 	}
+	resp, err := pi.signDeliveryAck(ack)
+	if err != nil {
+		log.Println("Unable to sign delivery ack:", err)
+		w.WriteHeader(status)
+		return
+	}
+	w.WriteHeader(status)
+	_, err = w.Write(resp)
+	if err != nil {
+		log.Println(err)
+	}
 }
 
-var privateInfoMap = make(map[string]*PrivateInfoS)
-
-func (pi *PrivateInfoS) InitReachableLocal(path string) {
-	privateInfoMap[path] = pi
-}
-
+// processString - events in evt. Plain JSON is taken as it is, anything
+// else has to decrypt to events, or to an Envelope of them. Envelopes are
+// opened only once they are decrypted, and are not nested.
 func processString(pi *PrivateInfoS, evt string, keyid string) (evts []Event) {
 	//log.Println("str:", evt)
-	// json decode
-	var tmpDecode Event
-	err0 := json.Unmarshal([]byte(evt), &evts)
-	err1 := json.Unmarshal([]byte(evt), &tmpDecode)
-	if err1 == nil && tmpDecode.Uuid != "" {
-		evts = append(evts, tmpDecode)
-	}
-
-	// assume plaintext
-
-	if err0 != nil && err1 != nil {
+	evts, ok := decodeEvents(evt)
+	if !ok {
 		// We have failed to unmarshal them, let's decrypt them
 		str, _keyid, err := pi.Decrypt(evt)
 		keyid = _keyid
 		log.Println("keyid:", keyid)
-		for i := range evts {
-			evts[i].InternalKeyID = keyid
-		}
-		if err != nil {
+		if err != nil || str == "" {
 			log.Println(err)
 			// malformed or encrypted with different publickey.
+			pi.metricsDecryptionFailure()
 			return evts
 		}
-
-		return append(evts, processString(pi, str, keyid)...)
+		inner, isEnvelope, err := openEnvelope(str)
+		if isEnvelope {
+			if err != nil {
+				log.Println("Unable to open envelope:", err)
+				return evts
+			}
+			str = inner
+		}
+		evts, _ = decodeEvents(str)
 	}
 	for i := range evts {
 		evts[i].InternalKeyID = keyid
@@ -178,3 +171,15 @@ func processString(pi *PrivateInfoS, evt string, keyid string) (evts []Event) {
 	// log.Println("processString: evts:", evts)
 	return evts
 }
+
+// decodeEvents - JSON event, or a list of them. ok is false if str is
+// not JSON at all.
+func decodeEvents(str string) (evts []Event, ok bool) {
+	var tmpDecode Event
+	err0 := json.Unmarshal([]byte(str), &evts)
+	err1 := json.Unmarshal([]byte(str), &tmpDecode)
+	if err1 == nil && tmpDecode.Uuid != "" {
+		evts = append(evts, tmpDecode)
+	}
+	return evts, err0 == nil || err1 == nil
+}
@@ -0,0 +1,234 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// DefaultLocalServerPort - port that the local server listens on unless
+// configured otherwise.
+const DefaultLocalServerPort = 3893
+
+// DefaultLoopbackAddress - where /metrics and /stream.sse are served
+// unless configured otherwise, see LocalServer.LoopbackAddress.
+const DefaultLoopbackAddress = "127.0.0.1:3895"
+
+// LocalServer - http server that makes accounts registered in Accounts
+// reachable, along with files.http, mailbox.http and outbox.http.
+// Every LocalServer has its own accounts, limits and metrics, so running
+// a few of them in one process is fine.
+type LocalServer struct {
+	// Address - interface to bind to, empty means all of them.
+	Address string
+	// Port - 0 picks a random free port, see Addr.
+	Port int
+	// TLSCertFile and TLSKeyFile - if both are set we serve https.
+	TLSCertFile string
+	TLSKeyFile  string
+	// Metrics - expose /metrics on LoopbackAddress.
+	Metrics bool
+	// Stream - expose /stream.sse/{path} on LoopbackAddress, see
+	// StreamServe.
+	Stream bool
+	// Accounts - accounts served by this server, by their path.
+	Accounts *AccountRegistry
+	// I2PTunnelHost - address that the i2pd server tunnel connects from,
+	// X-I2P-DestB32 is trusted only in requests coming from it. Empty
+	// means that it is trusted from nobody.
+	I2PTunnelHost string
+	// LoopbackAddress - host:port that /metrics and /stream.sse are
+	// served on, never on Address. Has to be a loopback address, empty
+	// means DefaultLoopbackAddress.
+	LoopbackAddress string
+
+	lock     sync.Mutex
+	server   *http.Server
+	listener net.Listener
+	// loopback - serves LoopbackRouter, nil unless Metrics or Stream is
+	// set.
+	loopback         *http.Server
+	loopbackListener net.Listener
+	// closing - closed on Shutdown, ends the streams that would
+	// otherwise keep it waiting.
+	closing chan struct{}
+
+	metrics        *metricsRegistry
+	sourceLimiter  *rateLimiter
+	accountLimiter *rateLimiter
+}
+
+func NewLocalServer(address string, port int) *LocalServer {
+	return &LocalServer{
+		Address:        address,
+		Port:           port,
+		Accounts:       NewAccountRegistry(),
+		metrics:        newMetricsRegistry(),
+		sourceLimiter:  newRateLimiter(&INBOUND_SOURCE_RATE, &INBOUND_SOURCE_BURST),
+		accountLimiter: newRateLimiter(&INBOUND_ACCOUNT_RATE, &INBOUND_ACCOUNT_BURST),
+	}
+}
+
+// Router - routes served by the LocalServer.
+func (ls *LocalServer) Router() *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(middleware.Logger)
+	r.Get("/files.http/{sharedFor}/*", ls.FileServe)
+	r.Head("/files.http/{sharedFor}/*", ls.FileServe)
+	r.Post("/mailbox.http/{keyID}", ls.MailboxDeposit)
+	r.Get("/mailbox.http/{keyID}", ls.MailboxFetch)
+	r.Post("/mailbox.http/{keyID}/ack", ls.MailboxAck)
+	r.Get("/outbox.http/{sharedFor}", ls.OutboxFetch)
+	r.Post("/outbox.http/{sharedFor}/ack", ls.OutboxAck)
+	r.Get("/", ls.handleGet)
+	r.Post("/", ls.handlePost)
+	r.Get("/*", ls.handleGet)
+	r.Post("/*", ls.handlePost)
+	return r
+}
+
+// LoopbackRouter - routes served only on LoopbackAddress.
+func (ls *LocalServer) LoopbackRouter() *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(middleware.Logger)
+	if ls.Metrics {
+		r.Get("/metrics", ls.MetricsServe)
+	}
+	if ls.Stream {
+		if ls.closing == nil {
+			ls.closing = make(chan struct{})
+		}
+		r.Get("/stream.sse/{path}", ls.StreamServe(ls.closing))
+	}
+	return r
+}
+
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// Start - bind and start serving in the background. Errors that happen
+// while binding are returned, instead of killing the process.
+func (ls *LocalServer) Start() error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	if ls.server != nil {
+		return errors.New("local server is already running")
+	}
+	var loopbackListener net.Listener
+	if ls.Metrics || ls.Stream {
+		address := ls.LoopbackAddress
+		if address == "" {
+			address = DefaultLoopbackAddress
+		}
+		if !isLoopbackAddress(address) {
+			return errors.New("loopback address has to be a loopback address")
+		}
+		var err error
+		loopbackListener, err = net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(ls.Address, strconv.Itoa(ls.Port)))
+	if err != nil {
+		if loopbackListener != nil {
+			_ = loopbackListener.Close()
+		}
+		return err
+	}
+	tls := ls.TLSCertFile != "" && ls.TLSKeyFile != ""
+	ls.closing = make(chan struct{})
+	server := &http.Server{Handler: ls.Router()}
+	ls.server = server
+	ls.listener = listener
+	log.Println("starting on", listener.Addr().String(), "tls:", tls)
+	go func() {
+		var err error
+		if tls {
+			err = server.ServeTLS(listener, ls.TLSCertFile, ls.TLSKeyFile)
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("LocalServer stopped:", err)
+		}
+	}()
+	if loopbackListener != nil {
+		loopback := &http.Server{Handler: ls.LoopbackRouter()}
+		closing := ls.closing
+		loopback.RegisterOnShutdown(func() { close(closing) })
+		ls.loopback = loopback
+		ls.loopbackListener = loopbackListener
+		log.Println("serving local-only routes on", loopbackListener.Addr().String())
+		go func() {
+			err := loopback.Serve(loopbackListener)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Println("LocalServer loopback listener stopped:", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// Addr - address that we are actually listening on, empty if we are not
+// running.
+func (ls *LocalServer) Addr() string {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	if ls.listener == nil {
+		return ""
+	}
+	return ls.listener.Addr().String()
+}
+
+// LoopbackAddr - address of the loopback listener, empty if there is none.
+func (ls *LocalServer) LoopbackAddr() string {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	if ls.loopbackListener == nil {
+		return ""
+	}
+	return ls.loopbackListener.Addr().String()
+}
+
+func (ls *LocalServer) IsRunning() bool {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	return ls.server != nil
+}
+
+// Shutdown - stop accepting new connections and wait for in-flight
+// requests to finish, or for ctx to be done.
+func (ls *LocalServer) Shutdown(ctx context.Context) error {
+	ls.lock.Lock()
+	server := ls.server
+	loopback := ls.loopback
+	ls.server = nil
+	ls.listener = nil
+	ls.loopback = nil
+	ls.loopbackListener = nil
+	ls.lock.Unlock()
+	if server == nil {
+		return nil
+	}
+	if loopback != nil {
+		err := loopback.Shutdown(ctx)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return server.Shutdown(ctx)
+}
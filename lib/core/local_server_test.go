@@ -0,0 +1,89 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestLocalServerStartShutdown(t *testing.T) {
+	ls := NewLocalServer("127.0.0.1", 0)
+	if err := ls.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !ls.IsRunning() || ls.Addr() == "" {
+		t.Fatal("server should be running")
+	}
+	if err := ls.Start(); err == nil {
+		t.Fatal("server was started twice")
+	}
+	addr := ls.Addr()
+	if err := ls.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ls.IsRunning() || ls.Addr() != "" {
+		t.Fatal("server should be stopped")
+	}
+	if _, err := http.Get("http://" + addr + "/"); err == nil {
+		t.Fatal("server still answers after Shutdown")
+	}
+	if err := ls.Start(); err != nil {
+		t.Fatal("unable to start again:", err)
+	}
+	if err := ls.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalServerLoopbackAddress(t *testing.T) {
+	ls := NewLocalServer("127.0.0.1", 0)
+	ls.Metrics = true
+	ls.LoopbackAddress = "0.0.0.0:0"
+	if err := ls.Start(); err == nil {
+		_ = ls.Shutdown(context.Background())
+		t.Fatal("metrics were served on a public address")
+	}
+}
+
+func TestAccountRegistry(t *testing.T) {
+	ls := startTestServer(t)
+	alice := openTestAccount(t, ls, "alice")
+
+	get := func() int {
+		resp, err := http.Get("http://" + ls.Addr() + "/alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode
+	}
+	if code := get(); code != http.StatusOK {
+		t.Fatal("registered account is not served, got", code)
+	}
+	pi, ok := ls.Accounts.ByKeyID(alice.GetKeyID())
+	if !ok || pi != alice {
+		t.Fatal("account not found by key id")
+	}
+
+	if err := ClosePrivateInfo(alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ls.Accounts.ByPath("alice"); ok {
+		t.Fatal("closed account is still registered")
+	}
+	if code := get(); code == http.StatusOK {
+		t.Fatal("closed account is still served")
+	}
+	ls.Accounts.Register("alice", alice)
+	if _, ok := ls.Accounts.ByPath("alice"); ok {
+		t.Fatal("closed account got registered again")
+	}
+	if err := ClosePrivateInfo(alice); err == nil {
+		t.Fatal("account was closed twice")
+	}
+	if alice.Use() {
+		t.Fatal("closed account can be used")
+	}
+}
@@ -0,0 +1,315 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// Mailbox role - a p3pgo node can hold events for contacts that are
+// offline most of the time. Senders POST the (already encrypted) event
+// to the mailbox endpoint the same way they would to the recipient,
+// recipient later pulls held events and acknowledges them.
+// Mailbox host never sees anything but ciphertext.
+//
+// r.Post("/mailbox.http/{keyID}", MailboxDeposit)
+// r.Get("/mailbox.http/{keyID}", MailboxFetch)
+// r.Post("/mailbox.http/{keyID}/ack", MailboxAck)
+
+// MailboxMaxEvents - how many events are we willing to hold for a single
+// recipient.
+var MailboxMaxEvents int64 = 4096
+
+// MailboxRetention - held events older than that are dropped.
+var MailboxRetention = time.Hour * 24 * 30
+
+// MAILBOX_FETCH_INTERVAL - how often MailboxRunner pulls our mailboxes.
+var MAILBOX_FETCH_INTERVAL = time.Minute
+
+// MailboxRecipient - host side, contact that we agreed to hold events for.
+type MailboxRecipient struct {
+	gorm.Model
+	KeyID  string
+	Bearer string
+}
+
+// MailboxEvent - host side, opaque event held for MailboxRecipient.
+type MailboxEvent struct {
+	gorm.Model
+	RecipientKeyID string
+	Body           []byte
+}
+
+// MailboxEntry - single held event, as returned by MailboxFetch.
+type MailboxEntry struct {
+	ID   uint   `json:"id"`
+	Body []byte `json:"body"`
+}
+
+// Mailbox - recipient side, mailbox that holds events for us.
+type Mailbox struct {
+	gorm.Model
+	// DBKeyID - contact that is hosting the mailbox, empty if the
+	// mailbox was added manually.
+	DBKeyID        string `gorm:"column:db_key_id"`
+	Endpoint       Endpoint
+	Authentication string
+	// Outbox - this is not a mailbox but contact's outbox.http, that
+	// holds events addressed to us (see PullDelivery).
+	Outbox bool `gorm:"default:false"`
+}
+
+// HostMailboxFor - start holding events for given contact and let them
+// know about it with mailbox.offer event.
+func (pi *PrivateInfoS) HostMailboxFor(ui *UserInfo) *MailboxRecipient {
+	var mr MailboxRecipient
+	pi.DB.First(&mr, "key_id = ?", ui.GetKeyID())
+	if mr.Bearer == "" {
+		s, err := GenerateRandomStringURLSafe(128)
+		if err != nil {
+			log.Fatalln("Failed to generate random number", err)
+		}
+		mr.Bearer = s
+		mr.KeyID = ui.GetKeyID()
+		pi.DB.Save(&mr)
+	}
+	err := QueueEvent(pi, Event{
+		EventType: EventTypeMailboxOffer,
+		Data: EventDataMixed{
+			EventDataMailboxOffer: EventDataMailboxOffer{
+				MailboxEndpoint:       pi.GetMailboxEndpoint(mr.KeyID),
+				MailboxAuthentication: mr.Bearer,
+			},
+		},
+	}, ui)
+	if err != nil {
+		log.Println("Unable to queue mailbox offer:", err)
+	}
+	return &mr
+}
+
+// StopHostingMailboxFor - forget given contact's mailbox, including all
+// of the events that are still held.
+func (pi *PrivateInfoS) StopHostingMailboxFor(ui *UserInfo) {
+	pi.DB.Delete(&MailboxEvent{}, "recipient_key_id = ?", ui.GetKeyID())
+	pi.DB.Delete(&MailboxRecipient{}, "key_id = ?", ui.GetKeyID())
+}
+
+// GetMailboxEndpoint - endpoint that senders should use to reach keyid
+// through our mailbox.
+func (pi *PrivateInfoS) GetMailboxEndpoint(keyid string) Endpoint {
+	return pi.Endpoint.WithPath("/mailbox.http/" + keyid)
+}
+
+// AddMailbox - register mailbox that is holding events for us.
+func (pi *PrivateInfoS) AddMailbox(hostKeyID string, endpoint Endpoint, authentication string) *Mailbox {
+	var mb Mailbox
+	pi.DB.First(&mb, "endpoint = ?", string(endpoint))
+	mb.DBKeyID = hostKeyID
+	mb.Endpoint = endpoint
+	mb.Authentication = authentication
+	pi.DB.Save(&mb)
+	return &mb
+}
+
+func (pi *PrivateInfoS) DeleteMailbox(mb *Mailbox) {
+	pi.DB.Delete(mb)
+}
+
+func (pi *PrivateInfoS) GetMailboxes() (mbs []*Mailbox) {
+	pi.DB.Find(&mbs)
+	return mbs
+}
+
+func (pi *PrivateInfoS) GetMailboxByID(id uint) *Mailbox {
+	var mb Mailbox
+	pi.DB.First(&mb, "id = ?", id)
+	return &mb
+}
+
+// GetMailboxEndpoints - endpoints of our mailboxes, these are advertised
+// in introduce events.
+func (pi *PrivateInfoS) GetMailboxEndpoints() (endpoints []Endpoint) {
+	for _, mb := range pi.GetMailboxes() {
+		if mb.Outbox {
+			continue
+		}
+		endpoints = append(endpoints, mb.Endpoint)
+	}
+	return endpoints
+}
+
+// FetchMailboxes - pull, process and acknowledge events held for us in
+// all of our mailboxes, and in contacts' outboxes if we want PullDelivery.
+func (pi *PrivateInfoS) FetchMailboxes() {
+	for _, mb := range pi.GetMailboxes() {
+		if mb.Outbox && !pi.WantsPullDelivery() {
+			continue
+		}
+		err := pi.fetchMailbox(mb)
+		if err != nil {
+			log.Println("Unable to fetch mailbox", mb.Endpoint, err)
+		}
+	}
+}
+
+func (pi *PrivateInfoS) fetchMailbox(mb *Mailbox) error {
+	host := mb.Endpoint.GetHost()
+	b, err := i2pRequest("GET", host, nil, mb.Authentication, time.Second*60)
+	if err != nil {
+		return err
+	}
+	var entries []MailboxEntry
+	err = json.Unmarshal(b, &entries)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	var ids []uint
+	for i := range entries {
+		err := pi.tryProcessInbound(entries[i].Body)
+		if err != nil {
+			// Nobody is going to send it again, InboundRunner retries it.
+			log.Println("Unable to process mailbox event", entries[i].ID, err)
+			pi.finishInbound(pi.journalInbound(entries[i].Body, string(mb.Endpoint)), err)
+		}
+		ids = append(ids, entries[i].ID)
+	}
+	ack, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	_, err = i2pRequest("POST", host+"/ack", ack, mb.Authentication, time.Second*60)
+	return err
+}
+
+func (pi *PrivateInfoS) MailboxRunner() {
+	stop := pi.stop
+	for {
+		pi.helloOutboxes()
+		pi.FetchMailboxes()
+		if !pi.sleepOrStop(stop, MAILBOX_FETCH_INTERVAL) {
+			return
+		}
+	}
+}
+
+// byMailbox - account that hosts mailbox of keyID. Returned account is
+// in use, release it when you are done.
+func (ar *AccountRegistry) byMailbox(keyID string, auth string, requireAuth bool) (*PrivateInfoS, error) {
+	if strings.HasPrefix(auth, "Bearer ") {
+		auth = auth[len("Bearer "):]
+	}
+	if keyID == "" || (requireAuth && auth == "") {
+		return nil, errors.New("invalid data provided. No auth or keyID")
+	}
+	var found *PrivateInfoS
+	for _, pi := range ar.using() {
+		if found == nil {
+			var mr MailboxRecipient
+			pi.DB.First(&mr, "key_id = ?", keyID)
+			if mr.KeyID == keyID && (!requireAuth || mr.Bearer == auth) {
+				found = pi
+				continue
+			}
+		}
+		pi.release()
+	}
+	if found == nil {
+		return nil, errors.New("unable to find given mailbox")
+	}
+	return found, nil
+}
+
+func writeMailboxError(w http.ResponseWriter, status int, err error) {
+	w.WriteHeader(status)
+	_, err = w.Write([]byte(err.Error()))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// MailboxDeposit - accept an event for one of our mailbox recipients.
+func (ls *LocalServer) MailboxDeposit(w http.ResponseWriter, r *http.Request) {
+	keyID := chi.URLParam(r, "keyID")
+	pi, err := ls.Accounts.byMailbox(keyID, "", false)
+	if err != nil {
+		writeMailboxError(w, 404, err)
+		return
+	}
+	defer pi.release()
+	b := ls.readInbound(w, r, pi.metricsAccount())
+	if b == nil {
+		return
+	}
+	pi.DB.Delete(&MailboxEvent{}, "created_at < ?", time.Now().Add(-MailboxRetention))
+	var count int64
+	pi.DB.Model(&MailboxEvent{}).Where("recipient_key_id = ?", keyID).Count(&count)
+	if count >= MailboxMaxEvents {
+		writeMailboxError(w, 507, errors.New("mailbox is full"))
+		return
+	}
+	pi.DB.Save(&MailboxEvent{RecipientKeyID: keyID, Body: b})
+	_, err = w.Write([]byte("OK"))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// MailboxFetch - list events held for authenticated recipient.
+func (ls *LocalServer) MailboxFetch(w http.ResponseWriter, r *http.Request) {
+	keyID := chi.URLParam(r, "keyID")
+	pi, err := ls.Accounts.byMailbox(keyID, r.Header.Get("Authentication"), true)
+	if err != nil {
+		writeMailboxError(w, 403, err)
+		return
+	}
+	defer pi.release()
+	var mevts []MailboxEvent
+	pi.DB.Order("id ASC").Limit(50).Find(&mevts, "recipient_key_id = ?", keyID)
+	entries := []MailboxEntry{}
+	for i := range mevts {
+		entries = append(entries, MailboxEntry{ID: mevts[i].ID, Body: mevts[i].Body})
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		writeMailboxError(w, 500, err)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// MailboxAck - drop events that authenticated recipient has processed.
+func (ls *LocalServer) MailboxAck(w http.ResponseWriter, r *http.Request) {
+	keyID := chi.URLParam(r, "keyID")
+	pi, err := ls.Accounts.byMailbox(keyID, r.Header.Get("Authentication"), true)
+	if err != nil {
+		writeMailboxError(w, 403, err)
+		return
+	}
+	defer pi.release()
+	var ids []uint
+	err = json.NewDecoder(r.Body).Decode(&ids)
+	if err != nil {
+		writeMailboxError(w, 400, err)
+		return
+	}
+	if len(ids) != 0 {
+		pi.DB.Delete(&MailboxEvent{}, "recipient_key_id = ? AND id IN ?", keyID, ids)
+	}
+	_, err = w.Write([]byte("OK"))
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -26,9 +26,8 @@ func (pi *PrivateInfoS) GetMessagesByUserInfo(ui *UserInfo) []Message {
 	return msgs
 }
 
-func (pi *PrivateInfoS) SendMessage(ui *UserInfo, messageType MessageType, text string) {
+func (pi *PrivateInfoS) SendMessage(ui *UserInfo, messageType MessageType, text string) error {
 	log.Println("SendMessage", ui.GetKeyID(), messageType)
-	pi.DB.Save(&Message{KeyID: ui.GetKeyID(), Incoming: false, Body: text})
 	evt := Event{
 		InternalKeyID: ui.GetKeyID(),
 		EventType:     EventTypeMessage,
@@ -41,5 +40,19 @@ func (pi *PrivateInfoS) SendMessage(ui *UserInfo, messageType MessageType, text
 		},
 		Uuid: "",
 	}
-	QueueEvent(pi, evt, ui)
+	// Queued first, messages that can't be sent are not stored.
+	err := QueueEvent(pi, evt, ui)
+	if err != nil {
+		return err
+	}
+	msg := &Message{KeyID: ui.GetKeyID(), Incoming: false, Body: text}
+	pi.DB.Save(msg)
+	pi.publish(NotificationMessage, NotificationMessageData{
+		UserInfoID: ui.ID,
+		KeyID:      ui.GetKeyID(),
+		MessageID:  msg.ID,
+		Incoming:   false,
+		Text:       text,
+	})
+	return nil
 }
@@ -0,0 +1,230 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricRelayAttempts       = "p3p_relay_attempts_total"
+	metricRelaySuccesses      = "p3p_relay_successes_total"
+	metricRelayFailures       = "p3p_relay_failures_total"
+	metricRelayDuration       = "p3p_relay_post_duration_seconds"
+	metricInboundEvents       = "p3p_inbound_events_total"
+	metricDecryptionFailures  = "p3p_decryption_failures_total"
+	metricQueuedEvents        = "p3p_queued_events"
+	metricInboundRejections   = "p3p_inbound_rejections_total"
+	metricsDefaultAccountName = "unknown"
+)
+
+var metricsHelp = map[string]string{
+	metricRelayAttempts:      "Attempts to relay a queued event to an endpoint.",
+	metricRelaySuccesses:     "Queued events relayed and acknowledged by an endpoint.",
+	metricRelayFailures:      "Failed attempts to relay a queued event to an endpoint.",
+	metricRelayDuration:      "Time spent in i2pPost while relaying queued events.",
+	metricInboundEvents:      "Events received, by type.",
+	metricDecryptionFailures: "Received bodies that we were unable to decrypt.",
+	metricQueuedEvents:       "Events currently waiting in the queue, by endpoint.",
+	metricInboundRejections:  "Received requests rejected before processing, by reason.",
+}
+
+var metricsHistogramBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type metricsHistogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type metricsRegistry struct {
+	sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*metricsHistogram
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		counters:   make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*metricsHistogram),
+	}
+}
+
+// metricsLabels - render label pairs (key, value, key, value...).
+func metricsLabels(kv ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(kv[i+1])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, kv[i], v))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *metricsRegistry) inc(name string, labels string) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.counters[name] == nil {
+		m.counters[name] = make(map[string]float64)
+	}
+	m.counters[name][labels]++
+}
+
+func (m *metricsRegistry) observe(name string, labels string, value float64) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.histograms[name] == nil {
+		m.histograms[name] = make(map[string]*metricsHistogram)
+	}
+	h := m.histograms[name][labels]
+	if h == nil {
+		h = &metricsHistogram{buckets: make([]uint64, len(metricsHistogramBuckets))}
+		m.histograms[name][labels] = h
+	}
+	for i, le := range metricsHistogramBuckets {
+		if value <= le {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// mergeInto - add counters and histograms of m to dst.
+func (m *metricsRegistry) mergeInto(dst *metricsRegistry) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	for name, series := range m.counters {
+		if dst.counters[name] == nil {
+			dst.counters[name] = make(map[string]float64)
+		}
+		for labels, v := range series {
+			dst.counters[name][labels] += v
+		}
+	}
+	for name, series := range m.histograms {
+		if dst.histograms[name] == nil {
+			dst.histograms[name] = make(map[string]*metricsHistogram)
+		}
+		for labels, h := range series {
+			d := dst.histograms[name][labels]
+			if d == nil {
+				d = &metricsHistogram{buckets: make([]uint64, len(metricsHistogramBuckets))}
+				dst.histograms[name][labels] = d
+			}
+			for i := range h.buckets {
+				d.buckets[i] += h.buckets[i]
+			}
+			d.count += h.count
+			d.sum += h.sum
+		}
+	}
+}
+
+func (m *metricsRegistry) write(sb *strings.Builder) {
+	m.Lock()
+	defer m.Unlock()
+	for _, name := range sortedKeys(m.counters) {
+		fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s counter\n", name, metricsHelp[name], name)
+		for _, labels := range sortedKeys(m.counters[name]) {
+			fmt.Fprintf(sb, "%s{%s} %v\n", name, labels, m.counters[name][labels])
+		}
+	}
+	for _, name := range sortedKeys(m.histograms) {
+		fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s histogram\n", name, metricsHelp[name], name)
+		for _, labels := range sortedKeys(m.histograms[name]) {
+			h := m.histograms[name][labels]
+			for i, le := range metricsHistogramBuckets {
+				fmt.Fprintf(sb, "%s_bucket{%s,le=\"%v\"} %d\n", name, labels, le, h.buckets[i])
+			}
+			fmt.Fprintf(sb, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+			fmt.Fprintf(sb, "%s_sum{%s} %v\n", name, labels, h.sum)
+			fmt.Fprintf(sb, "%s_count{%s} %d\n", name, labels, h.count)
+		}
+	}
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricsAccount - label used for given account, that is the path it
+// is reachable on.
+func (pi *PrivateInfoS) metricsAccount() string {
+	if pi.EndpointPath != "" {
+		return pi.EndpointPath
+	}
+	return metricsDefaultAccountName
+}
+
+func (pi *PrivateInfoS) metricsRelay(endpoint Endpoint, took time.Duration, err error) {
+	labels := metricsLabels("account", pi.metricsAccount(), "endpoint", string(endpoint))
+	pi.metrics.inc(metricRelayAttempts, labels)
+	if err != nil {
+		pi.metrics.inc(metricRelayFailures, labels)
+	} else {
+		pi.metrics.inc(metricRelaySuccesses, labels)
+	}
+	pi.metrics.observe(metricRelayDuration, metricsLabels("account", pi.metricsAccount()), took.Seconds())
+}
+
+func (pi *PrivateInfoS) metricsInboundEvent(eventType EventType) {
+	pi.metrics.inc(metricInboundEvents, metricsLabels("account", pi.metricsAccount(), "type", string(eventType)))
+}
+
+func (pi *PrivateInfoS) metricsDecryptionFailure() {
+	pi.metrics.inc(metricDecryptionFailures, metricsLabels("account", pi.metricsAccount()))
+}
+
+func (ls *LocalServer) metricsInboundRejection(account string, reason string) {
+	ls.metrics.inc(metricInboundRejections, metricsLabels("account", account, "reason", reason))
+}
+
+// MetricsServe - Prometheus text format of everything above, for the
+// accounts served by ls, plus the current queue size of every one of them.
+// r.Get("/metrics", ls.MetricsServe)
+func (ls *LocalServer) MetricsServe(w http.ResponseWriter, r *http.Request) {
+	all := newMetricsRegistry()
+	ls.metrics.mergeInto(all)
+	pis := ls.Accounts.using()
+	for _, pi := range pis {
+		defer pi.release()
+		pi.metrics.mergeInto(all)
+	}
+	var sb strings.Builder
+	all.write(&sb)
+	fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s gauge\n", metricQueuedEvents, metricsHelp[metricQueuedEvents], metricQueuedEvents)
+	for _, pi := range pis {
+		var rows []struct {
+			Endpoint string
+			Count    int64
+		}
+		pi.DB.Model(&QueuedEvent{}).Select("endpoint, count(*) as count").Group("endpoint").Scan(&rows)
+		for _, row := range rows {
+			labels := metricsLabels("account", pi.metricsAccount(), "endpoint", row.Endpoint)
+			fmt.Fprintf(&sb, "%s{%s} %d\n", metricQueuedEvents, labels, row.Count)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, err := w.Write([]byte(sb.String()))
+	if err != nil {
+		log.Println(err)
+	}
+}
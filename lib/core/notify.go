@@ -0,0 +1,143 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// Notifications - what happened to the account, published to everyone
+// subscribed with Subscribe (for example StreamServe). Unlike callbacks
+// these are only informational, subscribers can't affect processing.
+const (
+	NotificationMessage        = "message"
+	NotificationIntroduce      = "introduce"
+	NotificationQueued         = "queue.added"
+	NotificationDelivered      = "queue.delivered"
+	NotificationDeliveryFailed = "queue.failed"
+	NotificationDownload       = "download.progress"
+	NotificationFilesChanged   = "files.changed"
+)
+
+// NotifySubscriberBuffer - notifications waiting for a slow subscriber,
+// anything above that is dropped.
+var NotifySubscriberBuffer = 64
+
+type Notification struct {
+	Type string      `json:"type"`
+	Time int64       `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+type NotificationMessageData struct {
+	UserInfoID uint   `json:"userInfoId"`
+	KeyID      string `json:"keyId"`
+	MessageID  uint   `json:"messageId,omitempty"`
+	Incoming   bool   `json:"incoming"`
+	Text       string `json:"text"`
+}
+
+type NotificationIntroduceData struct {
+	UserInfoID uint   `json:"userInfoId"`
+	KeyID      string `json:"keyId"`
+	Username   string `json:"username"`
+	// State - UserInfoStatePending for contact requests.
+	State string `json:"state"`
+}
+
+type NotificationQueueData struct {
+	QueuedEventID uint     `json:"queuedEventId"`
+	Uuid          string   `json:"uuid"`
+	KeyID         string   `json:"keyId"`
+	Endpoint      Endpoint `json:"endpoint,omitempty"`
+	RelayTries    int      `json:"relayTries,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type NotificationDownloadData struct {
+	DownloadID uint   `json:"downloadId"`
+	KeyID      string `json:"keyId"`
+	FilePath   string `json:"filePath"`
+	BytesDone  int64  `json:"bytesDone"`
+	SizeBytes  int64  `json:"sizeBytes"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+type NotificationFilesChangedData struct {
+	UserInfoID uint         `json:"userInfoId"`
+	KeyID      string       `json:"keyId"`
+	Changes    []FileChange `json:"changes"`
+}
+
+type notifyHub struct {
+	lock   sync.Mutex
+	subs   map[chan Notification]struct{}
+	closed bool
+}
+
+func newNotifyHub() *notifyHub {
+	return &notifyHub{subs: make(map[chan Notification]struct{})}
+}
+
+// Subscribe - receive notifications of pi until cancel is called or pi
+// is closed, then the channel gets closed.
+func (pi *PrivateInfoS) Subscribe() (ch <-chan Notification, cancel func()) {
+	c := make(chan Notification, NotifySubscriberBuffer)
+	h := pi.notify
+	if h == nil {
+		close(c)
+		return c, func() {}
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		close(c)
+		return c, func() {}
+	}
+	h.subs[c] = struct{}{}
+	return c, func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if _, ok := h.subs[c]; ok {
+			delete(h.subs, c)
+			close(c)
+		}
+	}
+}
+
+func (pi *PrivateInfoS) publish(notificationType string, data interface{}) {
+	h := pi.notify
+	if h == nil {
+		return
+	}
+	n := Notification{Type: notificationType, Time: time.Now().Unix(), Data: data}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for c := range h.subs {
+		select {
+		case c <- n:
+		default:
+			// subscriber is not keeping up.
+		}
+	}
+}
+
+func (h *notifyHub) close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.closed = true
+	for c := range h.subs {
+		delete(h.subs, c)
+		close(c)
+	}
+}
+
+func (evt *QueuedEvent) notificationData() NotificationQueueData {
+	return NotificationQueueData{
+		QueuedEventID: evt.ID,
+		Uuid:          evt.Uuid,
+		KeyID:         evt.KeyID,
+		Endpoint:      evt.Endpoint,
+		RelayTries:    evt.RelayTries,
+	}
+}
@@ -0,0 +1,212 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Pull-based delivery - contacts that can't host an inbound endpoint
+// (PullDelivery) poll our outbox.http instead. Events addressed to them
+// are queued with QueuedEvent.Pull set, EventQueueRunner leaves these
+// alone and we serve them here until they are acknowledged.
+// Authentication is the same bearer that is used for files.http.
+// Contacts learn about the outbox from our introduce, and from the
+// DeliveryAck of anything they POST to us (see outboxHeader), since the
+// introduce itself waits in the outbox.
+//
+// r.Get("/outbox.http/{sharedFor}", OutboxFetch)
+// r.Post("/outbox.http/{sharedFor}/ack", OutboxAck)
+
+// GetOutboxMetadata - where given user should poll for events we keep
+// for them.
+func (pi *PrivateInfoS) GetOutboxMetadata(ui *UserInfo) *OutboxMetadata {
+	if pi.Endpoint == "" {
+		return nil
+	}
+	return &OutboxMetadata{
+		Endpoint:       pi.Endpoint.WithPath("/outbox.http/" + ui.GetKeyID()),
+		Authentication: pi.RemoteFilesAccessBearer(ui),
+	}
+}
+
+// setOutbox - poll outbox (if any) for events that ui keeps for us.
+func (pi *PrivateInfoS) setOutbox(ui *UserInfo, outbox *OutboxMetadata) {
+	pi.DB.Delete(&Mailbox{}, "db_key_id = ? AND outbox = ?", ui.GetKeyID(), true)
+	if outbox != nil && outbox.Endpoint != "" {
+		mb := pi.AddMailbox(ui.GetKeyID(), outbox.Endpoint, outbox.Authentication)
+		mb.Outbox = true
+		pi.DB.Save(mb)
+	}
+}
+
+// outboxHeader - fingerprint of the sender, set on POSTs of accounts that
+// want PullDelivery. Their events are decrypted only later by the
+// InboundRunner, so this is how the DeliveryAck can still tell them where
+// our outbox is. Anyone can set it, so outbox metadata is encrypted for
+// the key that we know under that fingerprint.
+const outboxHeader = "X-P3P-Fingerprint"
+
+// pullFingerprint - outboxHeader value for our POSTs, empty if we don't
+// need anybody's outbox.
+func (pi *PrivateInfoS) pullFingerprint() string {
+	if !pi.WantsPullDelivery() {
+		return ""
+	}
+	return pi.GetFingerprint()
+}
+
+// outboxFor - DeliveryAck.Outbox for the contact with given fingerprint,
+// empty unless they want PullDelivery. Pending contacts get it too, so
+// that they are able to fetch our introduce once we accept them;
+// outbox.http only serves events addressed to them.
+func (pi *PrivateInfoS) outboxFor(fingerprint string) string {
+	if fingerprint == "" {
+		return ""
+	}
+	ui, err := pi.GetUserInfoByFingerprint(fingerprint)
+	if err != nil || !ui.PullDelivery {
+		return ""
+	}
+	if ui.State == UserInfoStateBlocked || ui.State == UserInfoStateRejected {
+		return ""
+	}
+	om := pi.GetOutboxMetadata(ui)
+	if om == nil {
+		return ""
+	}
+	b, err := json.Marshal(om)
+	if err != nil {
+		return ""
+	}
+	armored, err := pi.EncryptSign(ui.Publickey, string(b))
+	if err != nil {
+		log.Println("Unable to encrypt outbox metadata:", err)
+		return ""
+	}
+	return armored
+}
+
+// helloOutboxes - ask contacts whose outbox we don't know yet for it. Our
+// introduce may have been processed after it's DeliveryAck was sent, or
+// they may have accepted us since then; empty POST gets us a DeliveryAck
+// with nothing but the Outbox.
+func (pi *PrivateInfoS) helloOutboxes() {
+	if !pi.WantsPullDelivery() {
+		return
+	}
+	known := make(map[string]bool)
+	for _, mb := range pi.GetMailboxes() {
+		if mb.Outbox {
+			known[mb.DBKeyID] = true
+		}
+	}
+	for _, ui := range pi.GetAllUserInfo() {
+		if known[ui.GetKeyID()] || ui.Endpoint == "" {
+			continue
+		}
+		resp, err := i2pPostAs(ui.Endpoint.GetHost(), nil, pi.GetFingerprint())
+		if err != nil {
+			log.Println("Unable to ask for outbox of", ui.ID, err)
+			continue
+		}
+		ack, err := verifyDeliveryAck(ui.Publickey, resp)
+		if err == nil && ack.Outbox != "" {
+			pi.saveAckOutbox(ui, ack.Outbox)
+		}
+	}
+}
+
+// saveAckOutbox - store DeliveryAck.Outbox that ui sent us.
+func (pi *PrivateInfoS) saveAckOutbox(ui *UserInfo, armored string) {
+	if !pi.WantsPullDelivery() {
+		return
+	}
+	b, err := pi.DecryptVerify(armored, ui.Publickey)
+	if err != nil {
+		log.Println("Unable to decrypt outbox metadata:", err)
+		return
+	}
+	var om OutboxMetadata
+	err = json.Unmarshal([]byte(b), &om)
+	if err != nil {
+		log.Println("Invalid outbox metadata:", err)
+		return
+	}
+	for _, mb := range pi.GetMailboxes() {
+		if mb.Outbox && mb.DBKeyID == ui.GetKeyID() && mb.Endpoint == om.Endpoint && mb.Authentication == om.Authentication {
+			return
+		}
+	}
+	pi.setOutbox(ui, &om)
+}
+
+// GetPullQueuedEvents - events waiting in outbox.http for given user.
+func (pi *PrivateInfoS) GetPullQueuedEvents(ui *UserInfo) (qevts []*QueuedEvent) {
+	pi.DB.Order("id ASC").Find(&qevts, "pull = ? AND key_id = ?", true, ui.GetKeyID())
+	return qevts
+}
+
+// OutboxFetch - list events kept for authenticated contact.
+func (ls *LocalServer) OutboxFetch(w http.ResponseWriter, r *http.Request) {
+	sharedFor := chi.URLParam(r, "sharedFor")
+	pi, err := ls.Accounts.bySharedFor(sharedFor, r.Header.Get("Authentication"))
+	if err != nil {
+		writeMailboxError(w, 403, err)
+		return
+	}
+	defer pi.release()
+	var qevts []QueuedEvent
+	pi.DB.Order("id ASC").Limit(50).Find(&qevts, "pull = ? AND key_id = ?", true, sharedFor)
+	entries := []MailboxEntry{}
+	for i := range qevts {
+		// Introductions may have waited here for longer than their
+		// signature and stamp are valid, same as in Relay.
+		err := qevts[i].rebuild(pi)
+		if err != nil {
+			log.Println("Unable to rebuild pull event", qevts[i].ID, err)
+			continue
+		}
+		entries = append(entries, MailboxEntry{ID: qevts[i].ID, Body: qevts[i].Body})
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		writeMailboxError(w, 500, err)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// OutboxAck - drop events that authenticated contact has processed.
+func (ls *LocalServer) OutboxAck(w http.ResponseWriter, r *http.Request) {
+	sharedFor := chi.URLParam(r, "sharedFor")
+	pi, err := ls.Accounts.bySharedFor(sharedFor, r.Header.Get("Authentication"))
+	if err != nil {
+		writeMailboxError(w, 403, err)
+		return
+	}
+	defer pi.release()
+	var ids []uint
+	err = json.NewDecoder(r.Body).Decode(&ids)
+	if err != nil {
+		writeMailboxError(w, 400, err)
+		return
+	}
+	if len(ids) != 0 {
+		var qevts []*QueuedEvent
+		pi.DB.Find(&qevts, "pull = ? AND key_id = ? AND id IN ?", true, sharedFor, ids)
+		for _, qevt := range qevts {
+			pi.DB.Delete(qevt)
+			pi.publish(NotificationDelivered, qevt.notificationData())
+		}
+	}
+	_, err = w.Write([]byte("OK"))
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -2,7 +2,10 @@ package core
 
 import (
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
 
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/ProtonMail/gopenpgp/v2/helper"
@@ -11,23 +14,83 @@ import (
 
 type PrivateInfoS struct {
 	gorm.Model
-	ID          uint
-	Username    string
-	Bio         string
+	ID       uint
+	Username string
+	Bio      string
+	// Avatar - image, only it's hash is part of the discovery document.
+	Avatar      []byte
 	PrivateKey  string
 	PublicKey   string
 	AccountName string
 	Passphrase  []byte
 	Endpoint    Endpoint
-	IsMini      bool
+	// AlternateEndpoints - other ways to reach us, advertised after
+	// Endpoint.
+	AlternateEndpoints []Endpoint `gorm:"serializer:json"`
+	IsMini             bool
+	// PullDelivery - we can't be reached on Endpoint, contacts should
+	// keep events for us and we will poll their outbox.http.
+	PullDelivery bool
+	// DiscoveryMode - who can GET our discovery document, see
+	// DiscoveryModePublic.
+	DiscoveryMode string `gorm:"default:public"`
+	// DiscoveryHideProfile - leave username, bio and avatar out of the
+	// discovery document unless the request is authenticated.
+	DiscoveryHideProfile bool `gorm:"default:false"`
+	// IntroduceStampBits - proof of work required from strangers, see
+	// SetIntroduceStampBits.
+	IntroduceStampBits int `gorm:"default:0"`
+	// StreamToken - authenticates local UIs to StreamServe.
+	StreamToken string
 	//
 	StorePath string
+	// EndpointPath - path that the account is reachable on, in the
+	// local server.
+	EndpointPath string `gorm:"-"`
 	//
 	DB *gorm.DB `gorm:"-"`
 	// Callbacks
 	MessageCallback   []func(pi *PrivateInfoS, ui *UserInfo, evt *Event, msg *Message) `gorm:"-"`
 	IntroduceCallback []func(pi *PrivateInfoS, ui *UserInfo, evt *Event)               `gorm:"-"`
 	EventCallback     []func(pi *PrivateInfoS, evt *Event)                             `gorm:"-"`
+	DownloadCallback  []func(pi *PrivateInfoS, ui *UserInfo, d *Download)              `gorm:"-"`
+	// FilesChangedCallback - contact has changed files shared with us.
+	FilesChangedCallback []func(pi *PrivateInfoS, ui *UserInfo, changes []FileChange) `gorm:"-"`
+
+	inboundWake chan struct{}
+	// stop - closed by ClosePrivateInfo.
+	stop chan struct{}
+	// notify - subscribers of Subscribe.
+	notify *notifyHub
+	// chunkLocks - one per chunk set that is being collected.
+	chunkLocks keyedLocks
+	// relayLock - guards relayTimeout and relayRunning of EventQueueRunner.
+	relayLock sync.Mutex
+	// relayTimeout - rounds to skip an endpoint for, after it has failed.
+	relayTimeout map[string]int
+	// relayRunning - endpoints that are being relayed to.
+	relayRunning map[string]bool
+	// runningDownloads - IDs of downloads that are in progress, so that
+	// the same file isn't written twice at once.
+	runningDownloads sync.Map
+	// metrics - counters of this account, see LocalServer.MetricsServe.
+	metrics *metricsRegistry
+	// lifecycle - guards closed and registries.
+	lifecycle sync.Mutex
+	closed    bool
+	// registries - AccountRegistry instances that pi is registered in.
+	registries []*AccountRegistry
+	// busy - runners and requests that use pi, see use.
+	busy sync.WaitGroup
+}
+
+// GetEndpoints - Endpoint followed by AlternateEndpoints.
+func (pi *PrivateInfoS) GetEndpoints() EndpointList {
+	return mergeEndpoints(append([]Endpoint{pi.Endpoint}, pi.AlternateEndpoints...))
+}
+
+func (pi *PrivateInfoS) WantsPullDelivery() bool {
+	return pi.PullDelivery || pi.Endpoint == ""
 }
 
 func (pi *PrivateInfoS) IsAccountReady() bool {
@@ -39,39 +102,46 @@ func (pi *PrivateInfoS) IsAccountReady() bool {
 func (pi *PrivateInfoS) Refresh() {
 	pi.DB.First(pi, "1 = 1") // Unsure if '1 = 1' is needed?
 }
-func (pi *PrivateInfoS) Create(username string, email string, bitSize int) {
+
+// Create - generate our key, errors are returned instead of killing the
+// process, so that a daemon creating accounts on request survives them.
+func (pi *PrivateInfoS) Create(username string, email string, bitSize int) error {
 	pi.DB.FirstOrCreate(pi)
 	if len(pi.Passphrase) != 0 {
-		log.Fatalln("WARN: Unable to CreatePrivateInfo - because PrivateInfo is not empty.")
-		return
+		return errors.New("unable to CreatePrivateInfo - because PrivateInfo is not empty")
+	}
+	if bitSize <= 0 {
+		return errors.New("invalid key size")
 	}
-	pi.Passphrase = make([]byte, bitSize*16)
+	passphrase := make([]byte, bitSize*16)
 	// then we can call rand.Read.
-	_, err := rand.Read(pi.Passphrase)
+	_, err := rand.Read(passphrase)
 	if err != nil {
-		log.Fatalln("Failed to read random data.", err)
+		return fmt.Errorf("failed to read random data: %w", err)
 	}
-	if pi.PrivateKey == "" {
+	privateKey := pi.PrivateKey
+	if privateKey == "" {
 		log.Println("PrivateKey is missing. Generating one.")
-		var err error
-		pi.PrivateKey, err = helper.GenerateKey(username, email, pi.Passphrase, "rsa", bitSize)
+		privateKey, err = helper.GenerateKey(username, email, passphrase, "rsa", bitSize)
 		if err != nil {
-			log.Fatalln("Unable to generate privkey:", err)
+			return fmt.Errorf("unable to generate privkey: %w", err)
 		}
-		pi.DB.Save(&pi)
 	}
-	privKey, err := crypto.NewKeyFromArmored(pi.PrivateKey)
+	privKey, err := crypto.NewKeyFromArmored(privateKey)
 	if err != nil {
-		log.Fatalln("CRIT: Unable to unarmor generated key:", err)
+		return fmt.Errorf("unable to unarmor generated key: %w", err)
 	}
 
 	pubKey, err := privKey.GetArmoredPublicKey()
 	if err != nil {
-		log.Fatalln("Unable to get armored public key", err)
+		return fmt.Errorf("unable to get armored public key: %w", err)
 	}
+	pi.Passphrase = passphrase
+	pi.PrivateKey = privateKey
 	pi.PublicKey = pubKey
 	pi.Username = username
 	pi.DB.Save(&pi)
+	return nil
 }
 func (pi *PrivateInfoS) Decrypt(armored string) (msg string, keyid string, err error) {
 	ciphertext, err := crypto.NewPGPMessageFromArmored(armored)
@@ -98,6 +168,13 @@ func (pi *PrivateInfoS) Decrypt(armored string) (msg string, keyid string, err e
 
 	message, err := privateKeyRing.Decrypt(ciphertext, pi.getKeyRing(), 0)
 	if err != nil {
+		if message != nil {
+			// Decrypted, but signed by somebody that we don't know yet.
+			fingerprint := verifyIntroduceRequest(privateKeyRing, ciphertext, message.GetString())
+			if fingerprint != "" {
+				return message.GetString(), fingerprint, nil
+			}
+		}
 		log.Println(err)
 		return "", "", nil
 	}
@@ -174,10 +251,18 @@ func (pi *PrivateInfoS) getKeyRing() *crypto.KeyRing {
 	return c
 }
 func (pi *PrivateInfoS) GetDiscoveredUserInfo() DiscoveredUserInfo {
-	return DiscoveredUserInfo{
-		Name:      pi.Username,
-		Bio:       pi.Bio,
-		PublicKey: pi.PublicKey,
-		Endpoint:  string(pi.Endpoint),
+	dui := DiscoveredUserInfo{
+		Version:      DiscoveryVersion,
+		Name:         pi.Username,
+		Bio:          pi.Bio,
+		PublicKey:    pi.PublicKey,
+		Endpoint:     string(pi.Endpoint),
+		Endpoints:    pi.GetEndpoints(),
+		Capabilities: Capabilities,
+		StampBits:    pi.IntroduceStampBits,
+	}
+	if len(pi.Avatar) != 0 {
+		dui.AvatarHash = sha256Hex(pi.Avatar)
 	}
+	return dui
 }
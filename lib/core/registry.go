@@ -0,0 +1,171 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// AccountRegistry - accounts that are reachable through a LocalServer,
+// by their routing path. Safe for concurrent use.
+type AccountRegistry struct {
+	lock   sync.RWMutex
+	byPath map[string]*PrivateInfoS
+}
+
+func NewAccountRegistry() *AccountRegistry {
+	return &AccountRegistry{byPath: make(map[string]*PrivateInfoS)}
+}
+
+// Register - make pi reachable on given path, replacing whatever account
+// was there before.
+func (ar *AccountRegistry) Register(path string, pi *PrivateInfoS) {
+	pi.lifecycle.Lock()
+	defer pi.lifecycle.Unlock()
+	if pi.closed {
+		return
+	}
+	ar.lock.Lock()
+	ar.byPath[path] = pi
+	ar.lock.Unlock()
+	for _, r := range pi.registries {
+		if r == ar {
+			return
+		}
+	}
+	pi.registries = append(pi.registries, ar)
+}
+
+// Unregister - remove all routes of pi.
+func (ar *AccountRegistry) Unregister(pi *PrivateInfoS) {
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+	for path := range ar.byPath {
+		if ar.byPath[path] == pi {
+			delete(ar.byPath, path)
+		}
+	}
+}
+
+func (ar *AccountRegistry) ByPath(path string) (*PrivateInfoS, bool) {
+	ar.lock.RLock()
+	defer ar.lock.RUnlock()
+	pi, ok := ar.byPath[path]
+	return pi, ok
+}
+
+func (ar *AccountRegistry) ByKeyID(keyid string) (*PrivateInfoS, bool) {
+	for _, pi := range ar.All() {
+		if pi.GetKeyID() == keyid {
+			return pi, true
+		}
+	}
+	return nil, false
+}
+
+// All - registered accounts, sorted by path.
+func (ar *AccountRegistry) All() []*PrivateInfoS {
+	ar.lock.RLock()
+	defer ar.lock.RUnlock()
+	var pis []*PrivateInfoS
+	for _, path := range sortedKeys(ar.byPath) {
+		pis = append(pis, ar.byPath[path])
+	}
+	return pis
+}
+
+// using - like All, but every returned account is in use, release them
+// when you are done.
+func (ar *AccountRegistry) using() []*PrivateInfoS {
+	var pis []*PrivateInfoS
+	for _, pi := range ar.All() {
+		if pi.use() {
+			pis = append(pis, pi)
+		}
+	}
+	return pis
+}
+
+// usingPath - like ByPath, returned account is in use.
+func (ar *AccountRegistry) usingPath(path string) (*PrivateInfoS, bool) {
+	pi, ok := ar.ByPath(path)
+	if !ok || !pi.use() {
+		return nil, false
+	}
+	return pi, true
+}
+
+// ClosePrivateInfo - remove routes of pi, stop its background runners,
+// wait for them and for requests in progress, and close the database.
+// pi must not be used afterwards.
+func ClosePrivateInfo(pi *PrivateInfoS) error {
+	pi.lifecycle.Lock()
+	if pi.stop == nil || pi.closed {
+		pi.lifecycle.Unlock()
+		return errors.New("private info is not open")
+	}
+	pi.closed = true
+	registries := pi.registries
+	pi.registries = nil
+	pi.lifecycle.Unlock()
+	for _, ar := range registries {
+		ar.Unregister(pi)
+	}
+	close(pi.stop)
+	pi.notify.close()
+	pi.busy.Wait()
+	db, err := pi.DB.DB()
+	if err != nil {
+		return err
+	}
+	log.Println("ClosePrivateInfo:", pi.metricsAccount())
+	return db.Close()
+}
+
+// use - mark pi as busy, ClosePrivateInfo waits until release is called
+// before it closes the database. false if pi is closed already.
+func (pi *PrivateInfoS) use() bool {
+	pi.lifecycle.Lock()
+	defer pi.lifecycle.Unlock()
+	if pi.closed {
+		return false
+	}
+	pi.busy.Add(1)
+	return true
+}
+
+func (pi *PrivateInfoS) release() {
+	pi.busy.Done()
+}
+
+// Use - use for callers outside of core, such as the C API.
+func (pi *PrivateInfoS) Use() bool {
+	return pi.use()
+}
+
+// Release - release for callers outside of core.
+func (pi *PrivateInfoS) Release() {
+	pi.release()
+}
+
+// goRun - run f in the background, ClosePrivateInfo waits for it.
+func (pi *PrivateInfoS) goRun(f func()) {
+	if !pi.use() {
+		return
+	}
+	go func() {
+		defer pi.release()
+		f()
+	}()
+}
+
+// sleepOrStop - wait for d, false if pi got closed in the meantime.
+func (pi *PrivateInfoS) sleepOrStop(stop chan struct{}, d time.Duration) bool {
+	select {
+	case <-stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"path"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 	// "gorm.io/driver/sqlite"
 	"github.com/glebarez/sqlite"
 )
@@ -27,44 +28,80 @@ func GetMD5Hash(text string) string {
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
+// LOG_TO_CONSOLE - log to stderr (and let gorm log to stdout), besides
+// log.txt in the store path.
+var LOG_TO_CONSOLE = true
+
 func OpenPrivateInfo(newStorePath string, accountName string, endpointPath string, isMini bool) *PrivateInfoS {
 	storePath = path.Join(newStorePath, GetMD5Hash(endpointPath))
 	_ = os.MkdirAll(storePath, 0750)
 	logPath = path.Join(storePath, "log.txt")
-	logFile, err := os.Create(logPath)
+	logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	mw := io.MultiWriter(logFile, os.Stderr)
+	var mw io.Writer = logFile
+	if LOG_TO_CONSOLE {
+		mw = io.MultiWriter(logFile, os.Stderr)
+	}
 	log.SetOutput(mw)
 	log.Println("OpenSqlite(): logger setup!")
 	log.Println("OpenSqlite(): opening sqlite database in:", storePath)
 	var pi = PrivateInfoS{AccountName: accountName, StorePath: storePath}
 
-	pi.DB, err = gorm.Open(sqlite.Open(path.Join(storePath, "p3p.db")), &gorm.Config{})
+	gormConfig := &gorm.Config{}
+	if !LOG_TO_CONSOLE {
+		gormConfig.Logger = logger.Default.LogMode(logger.Silent)
+	}
+	pi.DB, err = gorm.Open(sqlite.Open(path.Join(storePath, "p3p.db")), gormConfig)
 	if err != nil {
 		log.Fatalln(err)
 	}
 	log.Println("DB.AutoMigrate.UserInfo", pi.DB.AutoMigrate(&UserInfo{}))
 	log.Println("DB.AutoMigrate.QueuedEvent", pi.DB.AutoMigrate(&QueuedEvent{}))
+	if pi.DB.Migrator().HasColumn(&QueuedEvent{}, "plaintext") {
+		// Older versions kept cleartext copy of every encrypted event.
+		log.Println("DB.DropColumn.QueuedEvent.plaintext", pi.DB.Exec("ALTER TABLE queued_events DROP COLUMN plaintext").Error)
+	}
 	log.Println("DB.AutoMigrate.Message", pi.DB.AutoMigrate(&Message{}))
 	log.Println("DB.AutoMigrate.PrivateInfoS", pi.DB.AutoMigrate(&PrivateInfoS{}))
 	log.Println("DB.AutoMigrate.EndpointStats", pi.DB.AutoMigrate(&EndpointStats{}))
 	log.Println("DB.AutoMigrate.SharedFile", pi.DB.AutoMigrate(&SharedFile{}))
 	log.Println("DB.AutoMigrate.SharedForBearer", pi.DB.AutoMigrate(&SharedForBearer{}))
 	log.Println("DB.AutoMigrate.SharedFilesMetadata", pi.DB.AutoMigrate(&SharedFilesMetadata{}))
+	log.Println("DB.AutoMigrate.MailboxRecipient", pi.DB.AutoMigrate(&MailboxRecipient{}))
+	log.Println("DB.AutoMigrate.MailboxEvent", pi.DB.AutoMigrate(&MailboxEvent{}))
+	log.Println("DB.AutoMigrate.Mailbox", pi.DB.AutoMigrate(&Mailbox{}))
+	log.Println("DB.AutoMigrate.ProcessedEvent", pi.DB.AutoMigrate(&ProcessedEvent{}))
+	log.Println("DB.AutoMigrate.InboundChunk", pi.DB.AutoMigrate(&InboundChunk{}))
+	log.Println("DB.AutoMigrate.InboundEvent", pi.DB.AutoMigrate(&InboundEvent{}))
+	log.Println("DB.AutoMigrate.InviteToken", pi.DB.AutoMigrate(&InviteToken{}))
+	log.Println("DB.AutoMigrate.InviteTokenUse", pi.DB.AutoMigrate(&InviteTokenUse{}))
+	log.Println("DB.AutoMigrate.Download", pi.DB.AutoMigrate(&Download{}))
+	log.Println("DB.AutoMigrate.SyncFolder", pi.DB.AutoMigrate(&SyncFolder{}))
+	log.Println("DB.AutoMigrate.SyncedFile", pi.DB.AutoMigrate(&SyncedFile{}))
+	log.Println("DB.AutoMigrate.RemoteFile", pi.DB.AutoMigrate(&RemoteFile{}))
+	pi.migrateIntroductionRequests()
 
 	pi.Refresh()
 	pi.IsMini = isMini
+	pi.stop = make(chan struct{})
+	pi.notify = newNotifyHub()
+	pi.metrics = newMetricsRegistry()
+	pi.EndpointPath = endpointPath
 	if isMini {
 		log.Println(`NOTE: isMini = true`)
 		log.Println(`EventQueueRunner won't be run and you are on your own with relaying events'`)
 	} else {
-		go pi.EventQueueRunner()
+		pi.goRun(pi.EventQueueRunner)
+		pi.goRun(pi.SyncFolderRunner)
 	}
+	// Mini accounts are the ones that usually can't be reached, and have
+	// to poll for their events.
+	pi.goRun(pi.MailboxRunner)
 	pi.ensureProperUserInfo()
-	StartLocalServer()
-	pi.InitReachableLocal(endpointPath)
+	pi.inboundWake = make(chan struct{}, 1)
+	pi.goRun(pi.InboundRunner)
 	return &pi
 }
 
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+)
+
+// Proof of work - accounts can require introduce and introduce.request
+// events from keys that they don't know yet to carry a hashcash-style
+// stamp:
+//
+//	1:<bits>:<unix time>:<sender fingerprint>:<recipient fingerprint>:<counter>
+//
+// sha256 of the stamp has to start with at least IntroduceStampBits zero
+// bits. Required difficulty is advertised in the discovery document.
+
+// StampMaxAge - older stamps are not accepted.
+const StampMaxAge = time.Hour * 48
+
+// StampMaxBits - more than that would take forever to mint.
+const StampMaxBits = 32
+
+// StampMaxRemoteBits - most work that we agree to do for a peer. Each
+// bit doubles the time it takes to mint a stamp, anything above that is
+// treated as a peer trying to make us burn CPU, and peers running this
+// implementation won't contact accounts that ask for more.
+const StampMaxRemoteBits = 24
+
+// SetIntroduceStampBits - require stamps with at least bits zero bits from
+// strangers, 0 disables the check.
+func (pi *PrivateInfoS) SetIntroduceStampBits(bits int) error {
+	if bits < 0 || bits > StampMaxBits {
+		return fmt.Errorf("stamp bits have to be between 0 and %d", StampMaxBits)
+	}
+	pi.IntroduceStampBits = bits
+	pi.DB.Save(pi)
+	return nil
+}
+
+// mintStamp - find a stamp from sender to recipient worth at least bits.
+func mintStamp(bits int, sender string, recipient string) string {
+	prefix := fmt.Sprintf("1:%d:%d:%s:%s:", bits, time.Now().Unix(), strings.ToLower(sender), strings.ToLower(recipient))
+	for counter := uint64(0); ; counter++ {
+		stamp := prefix + strconv.FormatUint(counter, 16)
+		if stampBits(stamp) >= bits {
+			return stamp
+		}
+	}
+}
+
+// stampBits - number of leading zero bits in sha256 of the stamp.
+func stampBits(stamp string) int {
+	sum := sha256.Sum256([]byte(stamp))
+	n := 0
+	for _, b := range sum {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// verifyStamp - check that stamp is fresh, from sender to us and worth
+// at least IntroduceStampBits.
+func (pi *PrivateInfoS) verifyStamp(stamp string, sender string) error {
+	parts := strings.Split(stamp, ":")
+	if len(parts) != 6 || parts[0] != "1" {
+		return errors.New("missing or malformed stamp")
+	}
+	ts, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return err
+	}
+	created := time.Unix(ts, 0)
+	if time.Since(created) > StampMaxAge || created.After(time.Now().Add(DiscoveryMaxClockSkew)) {
+		return errors.New("stamp is expired")
+	}
+	if !strings.EqualFold(parts[3], sender) || !strings.EqualFold(parts[4], pi.GetFingerprint()) {
+		return errors.New("stamp is for somebody else")
+	}
+	if stampBits(stamp) < pi.IntroduceStampBits {
+		return errors.New("not enough work in stamp")
+	}
+	return nil
+}
+
+// checkStamp - false if evt is an introduction from a stranger without
+// enough work, such events should be dropped without touching the
+// database.
+func (pi *PrivateInfoS) checkStamp(evt *Event) bool {
+	if pi.IntroduceStampBits == 0 {
+		return true
+	}
+	var armored string
+	switch evt.EventType {
+	case EventTypeIntroduce:
+		armored = evt.Data.EventDataIntroduce.PublicKey
+	case EventTypeIntroduceRequest:
+		armored = evt.Data.EventDataIntroduceRequest.SelfPublicKey
+	default:
+		return true
+	}
+	publicKey, err := crypto.NewKeyFromArmored(armored)
+	if err != nil {
+		return false
+	}
+	_, err = pi.GetUserInfoByFingerprint(publicKey.GetFingerprint())
+	if err == nil {
+		return true
+	}
+	err = pi.verifyStamp(evt.Stamp, publicKey.GetFingerprint())
+	if err != nil {
+		log.Println("Dropping", evt.EventType, "from stranger:", err)
+		return false
+	}
+	return true
+}
+
+// checkStampBody - checkStamp for plaintext introduce bodies, before they
+// are journaled. Encrypted bodies are checked by TryProcess once they are
+// decrypted, still before any contact is saved; the journal itself is
+// bounded by INBOUND_JOURNAL_MAX.
+func (pi *PrivateInfoS) checkStampBody(body []byte) bool {
+	var evt Event
+	if json.Unmarshal(body, &evt) != nil {
+		return true
+	}
+	return pi.checkStamp(&evt)
+}
+
+// stampFor - stamp to attach to introductions sent to ui, empty if they
+// haven't asked for one.
+func (pi *PrivateInfoS) stampFor(ui *UserInfo) string {
+	if ui.StampBits == 0 {
+		return ""
+	}
+	return mintStamp(ui.StampBits, pi.GetFingerprint(), ui.Fingerprint)
+}
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStamp(t *testing.T) {
+	alice := createTestAccount(t, "alice")
+	bob := createTestAccount(t, "bob")
+	if err := bob.SetIntroduceStampBits(8); err != nil {
+		t.Fatal(err)
+	}
+	stamp := mintStamp(8, alice.GetFingerprint(), bob.GetFingerprint())
+	if stampBits(stamp) < 8 {
+		t.Fatal("minted stamp is worth", stampBits(stamp), "bits")
+	}
+	if err := bob.verifyStamp(stamp, alice.GetFingerprint()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStampRejected(t *testing.T) {
+	alice := createTestAccount(t, "alice")
+	bob := createTestAccount(t, "bob")
+	if err := bob.SetIntroduceStampBits(StampMaxBits + 1); err == nil {
+		t.Fatal("unreasonable stamp bits were accepted")
+	}
+	if err := bob.SetIntroduceStampBits(12); err != nil {
+		t.Fatal(err)
+	}
+	sender := alice.GetFingerprint()
+
+	var tooCheap string
+	for counter := 0; tooCheap == "" || stampBits(tooCheap) >= 12; counter++ {
+		tooCheap = fmt.Sprintf("1:12:%d:%s:%s:%x", time.Now().Unix(), sender, bob.GetFingerprint(), counter)
+	}
+	old := fmt.Sprintf("1:0:%d:%s:%s:0", time.Now().Add(-StampMaxAge-time.Hour).Unix(), sender, bob.GetFingerprint())
+	tests := []struct {
+		name   string
+		stamp  string
+		sender string
+	}{
+		{"missing", "", sender},
+		{"malformed", "1:12:not a stamp", sender},
+		{"too cheap", tooCheap, sender},
+		{"other recipient", mintStamp(12, sender, alice.GetFingerprint()), sender},
+		{"other sender", mintStamp(12, sender, bob.GetFingerprint()), bob.GetFingerprint()},
+		{"expired", old, sender},
+	}
+	for _, tt := range tests {
+		if err := bob.verifyStamp(tt.stamp, tt.sender); err == nil {
+			t.Errorf("%s stamp was accepted", tt.name)
+		}
+	}
+}
+
+func TestStampMaxRemoteBits(t *testing.T) {
+	alice := createTestAccount(t, "alice")
+	b, err := alice.signDiscovery(alice.GetDiscoveredUserInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyDiscovery(b, ""); err != nil {
+		t.Fatal(err)
+	}
+	dui := alice.GetDiscoveredUserInfo()
+	dui.StampBits = StampMaxRemoteBits + 1
+	b, err = alice.signDiscovery(dui)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = verifyDiscovery(b, "")
+	if err == nil || !strings.Contains(err.Error(), "proof of work") {
+		t.Fatal("expected too much proof of work to be refused, got", err)
+	}
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// StreamKeepAlive - how often an idle stream gets a comment line, so
+// proxies and clients don't time it out.
+var StreamKeepAlive = time.Second * 15
+
+// GetStreamToken - token required by StreamServe, generated on first use.
+func (pi *PrivateInfoS) GetStreamToken() string {
+	if pi.StreamToken == "" {
+		s, err := GenerateRandomStringURLSafe(64)
+		if err != nil {
+			log.Fatalln("Failed to generate random number", err)
+		}
+		pi.StreamToken = s
+		pi.DB.Save(pi)
+	}
+	return pi.StreamToken
+}
+
+// StreamServe - stream notifications of the account as text/event-stream.
+// Token is accepted in Authentication header only, query strings end up
+// in logs. It is served on the loopback listener, see LocalServer.
+// r.Get("/stream.sse/{path}", ls.StreamServe(closing))
+func (ls *LocalServer) StreamServe(closing <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pi, ok := ls.Accounts.usingPath(chi.URLParam(r, "path"))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		defer pi.release()
+		token := strings.TrimPrefix(r.Header.Get("Authentication"), "Bearer ")
+		if pi.StreamToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(pi.StreamToken)) != 1 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		notifications, cancel := pi.Subscribe()
+		defer cancel()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		keepAlive := time.NewTicker(StreamKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-closing:
+				return
+			case <-keepAlive.C:
+				_, err := fmt.Fprint(w, ": keepalive\n\n")
+				if err != nil {
+					return
+				}
+			case n, ok := <-notifications:
+				if !ok {
+					return // account got closed
+				}
+				b, err := json.Marshal(n)
+				if err != nil {
+					log.Println("Unable to marshal notification:", err)
+					continue
+				}
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", n.Type, b)
+				if err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package core
 
 import (
-	"encoding/json"
 	"errors"
 	"log"
 	"strings"
@@ -19,6 +18,30 @@ type UserInfo struct {
 	Fingerprint string   `json:"-"`
 	KeyID       string   `json:"-"`
 	Endpoint    Endpoint `json:"endpoint"`
+	// Endpoints - every endpoint that the user has advertised, in order of
+	// preference. Endpoint is always tried first, see GetEndpoints.
+	Endpoints []Endpoint `json:"endpoints" gorm:"serializer:json"`
+	// Mailboxes - store-and-forward endpoints that hold events for this
+	// user while Endpoint is unreachable.
+	Mailboxes []Endpoint `json:"mailboxes" gorm:"serializer:json"`
+	// PullDelivery - user can't be reached, events are kept in our
+	// outbox.http until they poll it.
+	PullDelivery bool `json:"pullDelivery" gorm:"default:false"`
+	// Capabilities - protocol features the user has advertised.
+	Capabilities []string `json:"capabilities" gorm:"serializer:json"`
+	// InviteToken - token from the invite we have accepted (or the one
+	// that we have requested introduction with), sent along with our
+	// introduce until they introduce themselves back.
+	InviteToken string `json:"-"`
+	// State - whether we want to hear from the user, see
+	// UserInfoStateAccepted.
+	State string `json:"state" gorm:"default:accepted;index"`
+	// IntroducedAt - timestamp of the last introduce we have accepted
+	// from the user, ones that aren't newer are replays.
+	IntroducedAt int64 `json:"-"`
+	// StampBits - proof of work that the user wants on introductions,
+	// from their discovery document.
+	StampBits int `json:"-"`
 }
 
 type FilesMetadata struct {
@@ -37,7 +60,7 @@ func (pi *PrivateInfoS) PurgeUser(ui *UserInfo) {
 	// Delete userinfo messages
 	pi.DB.Delete(&Message{}, "key_id = ?", ui.KeyID)
 	// Delete userinfo queued events
-	pi.DB.Delete(&QueuedEvent{}, "endpoint = ?", ui.Endpoint)
+	pi.DB.Delete(&QueuedEvent{}, "endpoint = ? OR key_id = ?", ui.Endpoint, ui.KeyID)
 	// Delete userinfo from db
 	pi.DB.Delete(&UserInfo{})
 }
@@ -54,6 +77,28 @@ func (ui *UserInfo) GetEndpointStats(pi *PrivateInfoS) *EndpointStats {
 	return pi.getEndpointStats(ui.Endpoint)
 }
 
+// GetEndpoints - all endpoints of the user, in order of preference.
+func (ui *UserInfo) GetEndpoints() []Endpoint {
+	return mergeEndpoints(append([]Endpoint{ui.Endpoint}, ui.Endpoints...))
+}
+
+// SetEndpoints - replace known endpoints, first one becomes Endpoint.
+func (ui *UserInfo) SetEndpoints(endpoints []Endpoint) {
+	ui.Endpoints = mergeEndpoints(endpoints)
+	ui.Endpoint = ""
+	if len(ui.Endpoints) != 0 {
+		ui.Endpoint = ui.Endpoints[0]
+	}
+}
+
+// GetEndpointStatsList - EndpointStats for each of GetEndpoints.
+func (ui *UserInfo) GetEndpointStatsList(pi *PrivateInfoS) (esl []*EndpointStats) {
+	for _, endpoint := range ui.GetEndpoints() {
+		esl = append(esl, pi.getEndpointStats(endpoint))
+	}
+	return esl
+}
+
 func (ui *UserInfo) GetKeyID() string {
 	publicKey, err := crypto.NewKeyFromArmored(ui.Publickey)
 	if err != nil {
@@ -81,19 +126,43 @@ func (pi *PrivateInfoS) GetKeyID() string {
 }
 
 func (ui *UserInfo) SendIntroduceEvent(pi *PrivateInfoS) {
+	internalEvent, err := pi.introduceEvent(ui)
+	if err != nil {
+		log.Println("Unable to sign introduce:", err)
+		return
+	}
+	err = QueueEvent(pi, internalEvent, ui)
+	if err != nil {
+		log.Println("Unable to queue introduce:", err)
+	}
+}
+
+// introduceEvent - signed introduce for ui, without a stamp.
+func (pi *PrivateInfoS) introduceEvent(ui *UserInfo) (Event, error) {
 	sfm := pi.GetSharedFilesMetadata(ui)
-	internalEvent := Event{
+	intro := EventDataIntroduce{
+		PublicKey:     pi.PublicKey,
+		Endpoints:     pi.GetEndpoints(),
+		Username:      pi.Username,
+		FilesMetadata: map[string]*SharedFilesMetadata{pi.GetKeyID(): &sfm},
+		Mailboxes:     pi.GetMailboxEndpoints(),
+		PullDelivery:  pi.WantsPullDelivery(),
+		Outbox:        pi.GetOutboxMetadata(ui),
+		Capabilities:  Capabilities,
+		InviteToken:   ui.InviteToken,
+		Recipient:     ui.Fingerprint,
+	}
+	signed, err := pi.signIntroduce(intro)
+	if err != nil {
+		return Event{}, err
+	}
+	intro.Signed = signed
+	return Event{
 		EventType: EventTypeIntroduce,
 		Data: EventDataMixed{
-			EventDataIntroduce: EventDataIntroduce{
-				PublicKey:     pi.PublicKey,
-				Endpoint:      pi.Endpoint,
-				Username:      pi.Username,
-				FilesMetadata: map[string]*SharedFilesMetadata{pi.GetKeyID(): &sfm},
-			},
+			EventDataIntroduce: intro,
 		},
-	}
-	QueueEvent(pi, internalEvent, ui)
+	}, nil
 }
 func (ui *UserInfo) GetReceivedSharedFilesMetadataIDs(pi *PrivateInfoS) []uint {
 	sfmsIds := []uint{}
@@ -130,8 +199,19 @@ func (pi *PrivateInfoS) GetUserInfoByKeyID(keyid string) (*UserInfo, error) {
 	return &ui, nil
 }
 
+func (pi *PrivateInfoS) GetUserInfoByFingerprint(fingerprint string) (*UserInfo, error) {
+	var ui UserInfo
+	fingerprint = strings.ToLower(fingerprint)
+	pi.DB.Find(&ui, "fingerprint = ?", fingerprint)
+	if fingerprint == "" || ui.Fingerprint != fingerprint {
+		return &UserInfo{Fingerprint: fingerprint}, errors.New("user with given fingerprint couldn't be found")
+	}
+	return &ui, nil
+}
+
+// GetAllUserInfo - accepted contacts, see GetUserInfoByState for the rest.
 func (pi *PrivateInfoS) GetAllUserInfo() (uis []*UserInfo) {
-	pi.DB.Find(&uis)
+	pi.DB.Find(&uis, "state = ?", UserInfoStateAccepted)
 	for i := range uis {
 		if uis[i].Fingerprint == "" && uis[i].Publickey == "" {
 			pi.DB.Delete(&uis[i])
@@ -143,7 +223,7 @@ func (pi *PrivateInfoS) GetAllUserInfo() (uis []*UserInfo) {
 
 func (pi *PrivateInfoS) GetAllUserIDs() (UserInfoIDs []uint) {
 	var uis []UserInfo
-	pi.DB.Find(&uis)
+	pi.DB.Find(&uis, "state = ?", UserInfoStateAccepted)
 	for i := range uis {
 		if uis[i].Fingerprint == "" && uis[i].Publickey == "" {
 			pi.DB.Delete(&uis[i])
@@ -154,7 +234,20 @@ func (pi *PrivateInfoS) GetAllUserIDs() (UserInfoIDs []uint) {
 	return UserInfoIDs
 }
 
+// CreateUserByPublicKey - add (or update) contact on user's request, the
+// contact becomes accepted even if it was blocked before.
 func (pi *PrivateInfoS) CreateUserByPublicKey(publicKeyArmored string, username string, endpoint Endpoint, shouldIntroduce bool) (*UserInfo, error) {
+	ui, err := pi.saveUserByPublicKey(publicKeyArmored, username, endpoint, UserInfoStateAccepted)
+	if err != nil {
+		return ui, err
+	}
+	if shouldIntroduce {
+		ui.SendIntroduceEvent(pi)
+	}
+	return ui, nil
+}
+
+func (pi *PrivateInfoS) saveUserByPublicKey(publicKeyArmored string, username string, endpoint Endpoint, state string) (*UserInfo, error) {
 	publicKey, err := crypto.NewKeyFromArmored(publicKeyArmored)
 	if err != nil {
 		log.Println("WARN: Unable to armor public key, returning.")
@@ -178,28 +271,50 @@ func (pi *PrivateInfoS) CreateUserByPublicKey(publicKeyArmored string, username
 	if ui.Endpoint == "" || endpoint != "" {
 		ui.Endpoint = Endpoint(endpoint)
 	}
+	ui.State = state
 	pi.DB.Save(&ui)
-	if shouldIntroduce {
-		ui.SendIntroduceEvent(pi)
-	}
 	return &ui, nil
 }
 
+// DiscoveredUserInfo - discovery document, served cleartext signed with
+// the account key (see signDiscovery).
 type DiscoveredUserInfo struct {
-	Name      string `json:"name"`
-	Bio       string `json:"bio"`
-	PublicKey string `json:"publickey"`
-	Endpoint  string `json:"endpoint"`
+	Version      int        `json:"version"`
+	Name         string     `json:"name"`
+	Bio          string     `json:"bio"`
+	PublicKey    string     `json:"publickey"`
+	Endpoint     string     `json:"endpoint"`
+	Endpoints    []Endpoint `json:"endpoints,omitempty"`
+	Capabilities []string   `json:"capabilities,omitempty"`
+	// AvatarHash - sha256 (hex) of the avatar, empty if there is none.
+	AvatarHash string `json:"avatarHash,omitempty"`
+	// StampBits - proof of work required on introductions, see mintStamp.
+	StampBits   int    `json:"stampBits,omitempty"`
+	Timestamp   int64  `json:"timestamp"`
+	Fingerprint string `json:"fingerprint"`
+	// Signed - false for legacy documents, see verifyDiscovery. Set by
+	// the receiver, never part of the document itself.
+	Signed bool `json:"signed,omitempty"`
 }
 
+// DiscoverUserByURL - fetch discovery document and make sure that it is
+// signed by the key that it contains.
 func DiscoverUserByURL(url string) (dui DiscoveredUserInfo, err error) {
-	b, err := i2pGet(url)
+	return DiscoverUserByURLWithAuth(url, "")
+}
+
+// DiscoverUserByURLWithAuth - same as DiscoverUserByURL, for accounts that
+// don't serve discovery publicly.
+func DiscoverUserByURLWithAuth(url string, auth string) (dui DiscoveredUserInfo, err error) {
+	return DiscoverUserByURLPinned(url, auth, "")
+}
+
+// DiscoverUserByURLPinned - same as DiscoverUserByURLWithAuth, document
+// has to carry the key with given fingerprint (unless it is empty).
+func DiscoverUserByURLPinned(url string, auth string, fingerprint string) (dui DiscoveredUserInfo, err error) {
+	b, err := i2pRequest("GET", url, nil, auth, time.Second*14)
 	if err != nil {
 		return DiscoveredUserInfo{}, err
 	}
-	err = json.Unmarshal(b, &dui)
-	if err != nil {
-		return dui, err
-	}
-	return dui, nil
+	return verifyDiscovery(b, fingerprint)
 }
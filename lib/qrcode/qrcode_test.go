@@ -0,0 +1,81 @@
+package qrcode
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// testData - n bytes of an invite link, upper cased every other repeat so
+// that longer symbols don't carry the same bytes over and over.
+func testData(n int) []byte {
+	s := "p3p://invite?endpoint=local://127.0.0.1:3893/alice&token=0123456789abcdef"
+	var b []byte
+	for len(b) < n {
+		b = append(b, s...)
+		s = strings.ToUpper(s)
+	}
+	return b[:n]
+}
+
+// TestEncodeGolden - symbols in testdata were produced by rsc.io/qr/coding
+// for the same data, level, version and mask, one module per character
+// ('#' dark, '.' light).
+func TestEncodeGolden(t *testing.T) {
+	tests := []struct {
+		golden  string
+		n       int
+		level   Level
+		version int
+	}{
+		{"v1-L.txt", 17, Low, 1},
+		{"v1-M.txt", 14, Medium, 1},
+		{"v1-Q.txt", 11, Quartile, 1},
+		{"v1-H.txt", 7, High, 1},
+		{"v2-M.txt", 26, Medium, 2},
+		{"v5-Q.txt", 60, Quartile, 5},
+		{"v7-L.txt", 154, Low, 7},
+		{"v10-H.txt", 119, High, 10},
+		{"v15-M.txt", 412, Medium, 15},
+		{"v31-Q.txt", 1000, Quartile, 31},
+		{"v40-L.txt", 2953, Low, 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			b, err := os.ReadFile(path.Join("testdata", tt.golden))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+			c, err := Encode(testData(tt.n), tt.level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Version != tt.version {
+				t.Fatalf("version %d, want %d", c.Version, tt.version)
+			}
+			if c.Size != len(want) {
+				t.Fatalf("size %d, want %d", c.Size, len(want))
+			}
+			for y, row := range want {
+				for x := range row {
+					if c.Black(x, y) != (row[x] == '#') {
+						t.Fatalf("module %d,%d differs", x, y)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	_, err := Encode(testData(2954), Low)
+	if err != ErrTooLong {
+		t.Fatal("expected ErrTooLong, got", err)
+	}
+	_, err = Encode(testData(1274), High)
+	if err != ErrTooLong {
+		t.Fatal("expected ErrTooLong, got", err)
+	}
+}
@@ -0,0 +1,59 @@
+package qrcode
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// QuietZone - light border around the symbol, in modules.
+const QuietZone = 4
+
+// Image - symbol with each module scale pixels wide.
+func (c *Code) Image(scale int) image.Image {
+	if scale < 1 {
+		scale = 1
+	}
+	size := (c.Size + QuietZone*2) * scale
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.White, color.Black})
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if c.Black(x/scale-QuietZone, y/scale-QuietZone) {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	return img
+}
+
+// PNG - Image encoded as PNG.
+func (c *Code) PNG(scale int) ([]byte, error) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, c.Image(scale))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG - symbol as SVG document, each module is scale units wide.
+func (c *Code) SVG(scale int) string {
+	if scale < 1 {
+		scale = 1
+	}
+	size := (c.Size + QuietZone*2) * scale
+	var path strings.Builder
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.Black(x, y) {
+				fmt.Fprintf(&path, "M%d %dh%dv%dh-%dz", (x+QuietZone)*scale, (y+QuietZone)*scale, scale, scale, scale)
+			}
+		}
+	}
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		size, size, size, size, path.String())
+}
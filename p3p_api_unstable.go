@@ -5,8 +5,11 @@ package main
 */
 import (
 	"C"
+	"context"
 	"encoding/json"
 	"log"
+	"os"
+	"time"
 
 	"git.mrcyjanek.net/p3pch4t/p3pgo/lib/core"
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
@@ -33,48 +36,154 @@ func HealthCheck() bool {
 
 var a []*core.PrivateInfoS
 
+// acquire - mark account piId as in use until a[piId].Release(), so that
+// ClosePrivateInfo waits for the call. false if piId is unknown or the
+// account is closed, exports return an empty value then.
+func acquire(piId int) bool {
+	if piId < 0 || piId >= len(a) || !a[piId].Use() {
+		log.Println("unknown or closed piId", piId)
+		return false
+	}
+	return true
+}
+
+// localServer - serves every account opened with OpenPrivateInfo, started
+// by the first one.
+var localServer = core.NewLocalServer("", core.DefaultLocalServerPort)
+
+//export StopLocalServer
+func StopLocalServer() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+	err := localServer.Shutdown(ctx)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+//export EnableMetrics
+func EnableMetrics() {
+	// NOTE: needs to be called before the first OpenPrivateInfo
+	// metrics are served on GetLoopbackAddress only.
+	localServer.Metrics = true
+}
+
+//export EnableStream
+func EnableStream() {
+	// NOTE: needs to be called before the first OpenPrivateInfo
+	// stream is served on GetLoopbackAddress only.
+	localServer.Stream = true
+}
+
+//export GetLoopbackAddress
+func GetLoopbackAddress() *C.char {
+	return C.CString(localServer.LoopbackAddr())
+}
+
+//export GetPrivateInfoStreamToken
+func GetPrivateInfoStreamToken(piId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	return C.CString(a[piId].GetStreamToken())
+}
+
 //export OpenPrivateInfo
 func OpenPrivateInfo(storePath *C.char, accountName *C.char, endpointPath *C.char, isMini bool) int {
+	if !localServer.IsRunning() {
+		err := localServer.Start()
+		if err != nil {
+			log.Println("Unable to start local server:", err)
+			return -1
+		}
+	}
 	pi := core.OpenPrivateInfo(C.GoString(storePath), C.GoString(accountName), C.GoString(endpointPath), isMini)
+	localServer.Accounts.Register(pi.EndpointPath, pi)
 	a = append(a, pi)
 	return len(a) - 1
 }
 
+//export ClosePrivateInfo
+func ClosePrivateInfo(piId int) bool {
+	if piId < 0 || piId >= len(a) {
+		log.Println("ClosePrivateInfo: unknown piId", piId)
+		return false
+	}
+	// pi stays in a, so that ids of other accounts are stable, acquire
+	// refuses it from now on.
+	err := core.ClosePrivateInfo(a[piId])
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
 //export ShowSetup
 func ShowSetup(piId int) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
 	return !a[piId].IsAccountReady()
 }
 
 //export CreateSelfInfo
 func CreateSelfInfo(piId int, username *C.char, email *C.char, bitSize int) bool {
-	a[piId].Create(C.GoString(username), C.GoString(email), bitSize)
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	err := a[piId].Create(C.GoString(username), C.GoString(email), bitSize)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
 	return true
 }
 
 //export GetAllUserInfo
 func GetAllUserInfo(piId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
 	ids := a[piId].GetAllUserIDs()
 	b, err := json.Marshal(ids)
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return C.CString("[]")
 	}
 	return C.CString(string(b))
 }
 
 //export AddUserByPublicKey
 func AddUserByPublicKey(piId int, publickey *C.char, username *C.char, endpoint *C.char) int {
+	if !acquire(piId) {
+		return -1
+	}
+	defer a[piId].Release()
 	ui, err := a[piId].CreateUserByPublicKey(C.GoString(publickey), C.GoString(username), core.Endpoint(C.GoString(endpoint)), true)
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return -1
 	}
 	return int(ui.ID)
 }
 
 //export ForceSendIntroduceEvent
 func ForceSendIntroduceEvent(piId int, uid int) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
 	ui, err := a[piId].GetUserInfoByID(uint(uid))
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return false
 	}
 	ui.SendIntroduceEvent(a[piId])
 	return true
@@ -96,11 +205,165 @@ func GetUserDetailsByURL(url *C.char) *C.char {
 	return C.CString(string(b))
 }
 
+//export GetUserInfoDiscovery
+func GetUserInfoDiscovery(piId int, uid int) *C.char {
+	if !acquire(piId) {
+		return C.CString("{}")
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err != nil {
+		log.Println(err)
+		return C.CString("{}")
+	}
+	dui, err := a[piId].DiscoverUserInfo(ui)
+	if err != nil {
+		log.Println(err)
+		return C.CString("{}")
+	}
+	b, err := json.Marshal(dui)
+	if err != nil {
+		log.Println(err)
+		return C.CString("{}")
+	}
+	return C.CString(string(b))
+}
+
+//export GetPrivateInfoDiscoveryMode
+func GetPrivateInfoDiscoveryMode(piId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	return C.CString(a[piId].DiscoveryMode)
+}
+
+//export GetPrivateInfoDiscoveryHideProfile
+func GetPrivateInfoDiscoveryHideProfile(piId int) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	return a[piId].DiscoveryHideProfile
+}
+
+//export SetPrivateInfoDiscoveryMode
+func SetPrivateInfoDiscoveryMode(piId int, mode *C.char, hideProfile bool) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	err := a[piId].SetDiscoveryMode(C.GoString(mode), hideProfile)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+//export GetPrivateInfoIntroduceStampBits
+func GetPrivateInfoIntroduceStampBits(piId int) int {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
+	return a[piId].IntroduceStampBits
+}
+
+//export SetPrivateInfoIntroduceStampBits
+func SetPrivateInfoIntroduceStampBits(piId int, bits int) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	err := a[piId].SetIntroduceStampBits(bits)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+//export GetPrivateInfoInvite
+func GetPrivateInfoInvite(piId int, token *C.char) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	return C.CString(a[piId].GetInvite(C.GoString(token)).String())
+}
+
+//export SavePrivateInfoInviteQRCode
+func SavePrivateInfoInviteQRCode(piId int, token *C.char, scale int, pngPath *C.char) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	b, err := a[piId].GetInvite(C.GoString(token)).QRCodePNG(scale)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	err = os.WriteFile(C.GoString(pngPath), b, 0644)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+//export GetPrivateInfoInviteQRCodeSVG
+func GetPrivateInfoInviteQRCodeSVG(piId int, token *C.char, scale int) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	svg, err := a[piId].GetInvite(C.GoString(token)).QRCodeSVG(scale)
+	if err != nil {
+		log.Println(err)
+		return C.CString("")
+	}
+	return C.CString(svg)
+}
+
+//export RequestIntroduction
+func RequestIntroduction(piId int, endpoint *C.char, token *C.char) int {
+	if !acquire(piId) {
+		return -1
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].RequestIntroduction(core.Endpoint(C.GoString(endpoint)), C.GoString(token))
+	if err != nil {
+		log.Println(err)
+		return -1
+	}
+	return int(ui.ID)
+}
+
+//export AcceptInvite
+func AcceptInvite(piId int, uri *C.char) int {
+	if !acquire(piId) {
+		return -1
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].AcceptInvite(C.GoString(uri))
+	if err != nil {
+		log.Println(err)
+		return -1
+	}
+	return int(ui.ID)
+}
+
 //export GetUserInfoMessages
 func GetUserInfoMessages(piId int, UserInfoID int) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
 	ui, err := a[piId].GetUserInfoByID(uint(UserInfoID))
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return C.CString("[]")
 	}
 	msgs := a[piId].GetMessagesByUserInfo(ui)
 	var msgids []uint
@@ -109,7 +372,8 @@ func GetUserInfoMessages(piId int, UserInfoID int) *C.char {
 	}
 	b, err := json.Marshal(msgids)
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return C.CString("[]")
 	}
 	return C.CString(string(b))
 }
@@ -118,24 +382,40 @@ func GetUserInfoMessages(piId int, UserInfoID int) *C.char {
 
 //export GetMessageType
 func GetMessageType(piId int, msgID int) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	//msg := core.GetMessageByID(a[piId], msgID)
 	return C.CString(string(core.MessageTypeText))
 }
 
 //export GetMessageText
 func GetMessageText(piId int, msgID int) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	msg := a[piId].GetMessageByID(msgID)
 	return C.CString(msg.Body)
 }
 
 //export GetMessageReceivedTimestamp
 func GetMessageReceivedTimestamp(piId int, msgID int) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	msg := a[piId].GetMessageByID(msgID)
 	return msg.CreatedAt.UnixMicro()
 }
 
 //export GetMessageIsIncoming
 func GetMessageIsIncoming(piId int, msgID int) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
 	msg := a[piId].GetMessageByID(msgID)
 	return msg.Incoming
 }
@@ -144,37 +424,60 @@ func GetMessageIsIncoming(piId int, msgID int) bool {
 
 //export GetUserInfoId
 func GetUserInfoId(piId int, uid int) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	ui, err := a[piId].GetUserInfoByID(uint(uid))
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return 0
 	}
 	return int64(ui.ID)
 }
 
 //export GetPrivateInfoId
 func GetPrivateInfoId(piId int) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	return int64(a[piId].ID)
 }
 
 //export GetUserInfoPublicKeyArmored
 func GetUserInfoPublicKeyArmored(piId int, uid int) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	ui, err := a[piId].GetUserInfoByID(uint(uid))
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return C.CString("")
 	}
 	return C.CString(ui.Publickey)
 }
 
 //export GetPrivateInfoPublicKeyArmored
 func GetPrivateInfoPublicKeyArmored(piId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	return C.CString(a[piId].PublicKey)
 }
 
 //export GetUserInfoUsername
 func GetUserInfoUsername(piId int, uid int) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	ui, err := a[piId].GetUserInfoByID(uint(uid))
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return C.CString("")
 	}
 	//b, _ := json.Marshal(ui)
 	return C.CString(ui.Username)
@@ -182,15 +485,24 @@ func GetUserInfoUsername(piId int, uid int) *C.char {
 
 //export GetPrivateInfoUsername
 func GetPrivateInfoUsername(piId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	return C.CString(a[piId].Username)
 }
 
 //export SetUserInfoUsername
 func SetUserInfoUsername(piId int, uid int, username *C.char) {
+	if !acquire(piId) {
+		return
+	}
+	defer a[piId].Release()
 	username0 := C.GoString(username)
 	ui, err := a[piId].GetUserInfoByID(uint(uid))
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return
 	}
 	ui.Username = username0
 	a[piId].DB.Save(&ui)
@@ -198,42 +510,220 @@ func SetUserInfoUsername(piId int, uid int, username *C.char) {
 
 //export SetPrivateInfoUsername
 func SetPrivateInfoUsername(piId int, username *C.char) {
+	if !acquire(piId) {
+		return
+	}
+	defer a[piId].Release()
 	a[piId].Username = C.GoString(username)
 	a[piId].DB.Save(a[piId])
 }
 
+//export SetPrivateInfoAvatar
+func SetPrivateInfoAvatar(piId int, avatarPath *C.char) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	b, err := os.ReadFile(C.GoString(avatarPath))
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	a[piId].Avatar = b
+	a[piId].DB.Save(a[piId])
+	return true
+}
+
 //export SetPrivateInfoEepsiteDomain
 func SetPrivateInfoEepsiteDomain(piId int, eepsite *C.char) {
+	if !acquire(piId) {
+		return
+	}
+	defer a[piId].Release()
 	a[piId].Endpoint = core.Endpoint("i2p://" + string(C.GoString(eepsite)) + "/")
 	a[piId].DB.Save(a[piId])
 }
 
 //export GetUserInfoEndpoint
 func GetUserInfoEndpoint(piId int, uid int) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	ui, err := a[piId].GetUserInfoByID(uint(uid))
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return C.CString("")
 	}
 	return C.CString(string(ui.Endpoint))
 }
 
 //export SetUserInfoEndpoint
 func SetUserInfoEndpoint(piId int, uid int, endpoint *C.char) {
+	if !acquire(piId) {
+		return
+	}
+	defer a[piId].Release()
 	ui, err := a[piId].GetUserInfoByID(uint(uid))
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return
 	}
 	ui.Endpoint = core.Endpoint(string(C.GoString(endpoint)))
 	a[piId].DB.Save(&ui)
 }
 
+//export GetPrivateInfoPullDelivery
+func GetPrivateInfoPullDelivery(piId int) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	return a[piId].WantsPullDelivery()
+}
+
+//export SetPrivateInfoPullDelivery
+func SetPrivateInfoPullDelivery(piId int, pullDelivery bool) {
+	if !acquire(piId) {
+		return
+	}
+	defer a[piId].Release()
+	a[piId].PullDelivery = pullDelivery
+	a[piId].DB.Save(a[piId])
+}
+
+//export GetUserInfoPullDelivery
+func GetUserInfoPullDelivery(piId int, uid int) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return ui.PullDelivery
+}
+
+//export GetUserInfoEndpoints
+func GetUserInfoEndpoints(piId int, uid int) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	b, err := json.Marshal(ui.GetEndpoints())
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	return C.CString(string(b))
+}
+
+//export SetUserInfoEndpoints
+func SetUserInfoEndpoints(piId int, uid int, endpointsJson *C.char) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	var endpoints []core.Endpoint
+	err = json.Unmarshal([]byte(C.GoString(endpointsJson)), &endpoints)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	ui.SetEndpoints(endpoints)
+	err = a[piId].DB.Save(ui).Error
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+//export GetUserInfoEndpointStatsIDs
+func GetUserInfoEndpointStatsIDs(piId int, uid int64) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	var ids = []uint{}
+	for _, es := range ui.GetEndpointStatsList(a[piId]) {
+		ids = append(ids, es.ID)
+	}
+	b, err := json.Marshal(ids)
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	return C.CString(string(b))
+}
+
+//export GetPrivateInfoEndpoints
+func GetPrivateInfoEndpoints(piId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
+	b, err := json.Marshal([]core.Endpoint(a[piId].GetEndpoints()))
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	return C.CString(string(b))
+}
+
+//export SetPrivateInfoAlternateEndpoints
+func SetPrivateInfoAlternateEndpoints(piId int, endpointsJson *C.char) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	var endpoints []core.Endpoint
+	err := json.Unmarshal([]byte(C.GoString(endpointsJson)), &endpoints)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	a[piId].AlternateEndpoints = endpoints
+	err = a[piId].DB.Save(a[piId]).Error
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
 //export GetPrivateInfoEndpoint
 func GetPrivateInfoEndpoint(piId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	return C.CString(string(a[piId].Endpoint))
 }
 
 //export SetPrivateInfoEndpoint
 func SetPrivateInfoEndpoint(piId int, endpoint *C.char) {
+	if !acquire(piId) {
+		return
+	}
+	defer a[piId].Release()
 	a[piId].Endpoint = core.Endpoint(string(C.GoString(endpoint)))
 	a[piId].DB.Save(a[piId])
 }
@@ -252,33 +742,54 @@ func GetPublicKeyFingerprint(armored *C.char) *C.char {
 }
 
 //export SendMessage
-func SendMessage(piId int, uid int64, text *C.char) {
+func SendMessage(piId int, uid int64, text *C.char) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
 	ui, err := a[piId].GetUserInfoByID(uint(uid))
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return false
+	}
+	err = a[piId].SendMessage(ui, core.MessageTypeText, C.GoString(text))
+	if err != nil {
+		log.Println(err)
+		return false
 	}
-	a[piId].SendMessage(ui, core.MessageTypeText, C.GoString(text))
+	return true
 }
 
 //export GetUserInfoEndpointStats
 func GetUserInfoEndpointStats(piId int, uid int64) uint {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	ui, err := a[piId].GetUserInfoByID(uint(uid))
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return 0
 	}
 	return ui.GetEndpointStats(a[piId]).ID
 }
 
 //export GetUserInfoSharedFilesMetadataIDs
 func GetUserInfoSharedFilesMetadataIDs(piId int, uid int64) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
 	ui, err := a[piId].GetUserInfoByID(uint(uid))
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return C.CString("[]")
 	}
 	list := ui.GetReceivedSharedFilesMetadataIDs(a[piId])
 	b, err := json.Marshal(list)
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return C.CString("[]")
 	}
 	return C.CString(string(b))
 }
@@ -287,6 +798,10 @@ func GetUserInfoSharedFilesMetadataIDs(piId int, uid int64) *C.char {
 
 //export GetQueuedEventIDs
 func GetQueuedEventIDs(piId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
 	qevts := a[piId].GetAllQueuedEvents()
 	var qevtsId []uint
 	for i := range qevts {
@@ -294,20 +809,29 @@ func GetQueuedEventIDs(piId int) *C.char {
 	}
 	b, err := json.Marshal(qevtsId)
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return C.CString("[]")
 	}
 	return C.CString(string(b))
 }
 
 //export GetQueuedEventCreatedAt
 func GetQueuedEventCreatedAt(piId int, queuedEventId int) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	qevt := a[piId].GetQueuedEvent(queuedEventId)
 	return qevt.CreatedAt.UnixMicro()
 }
 
 //export GetQueuedEventDeletedAt
 func GetQueuedEventDeletedAt(piId int, queuedEventId int) int64 {
-	qevt := a[piId].GetQueuedEvent(queuedEventId)
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
+	qevt := a[piId].GetQueuedEvent(queuedEventId)
 	if qevt.DeletedAt.Valid {
 		return qevt.DeletedAt.Time.UnixMicro()
 	}
@@ -316,54 +840,100 @@ func GetQueuedEventDeletedAt(piId int, queuedEventId int) int64 {
 
 //export GetQueuedEventUpdatedAt
 func GetQueuedEventUpdatedAt(piId int, queuedEventId int) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	qevt := a[piId].GetQueuedEvent(queuedEventId)
 	return qevt.UpdatedAt.UnixMicro()
 }
 
 //export GetQueuedEventLastRelayed
 func GetQueuedEventLastRelayed(piId int, queuedEventId int) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	qevt := a[piId].GetQueuedEvent(queuedEventId)
 	return qevt.LastRelayed.UnixMicro()
 }
 
 //export GetQueuedEventBody
 func GetQueuedEventBody(piId int, queuedEventId int) []byte {
+	if !acquire(piId) {
+		return nil
+	}
+	defer a[piId].Release()
 	qevt := a[piId].GetQueuedEvent(queuedEventId)
 	return qevt.Body
 }
 
 //export GetQueuedEventEndpoint
 func GetQueuedEventEndpoint(piId int, queuedEventId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	qevt := a[piId].GetQueuedEvent(queuedEventId)
 	return C.CString(string(qevt.Endpoint))
 }
 
+//export GetQueuedEventUuid
+func GetQueuedEventUuid(piId int, queuedEventId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	qevt := a[piId].GetQueuedEvent(queuedEventId)
+	return C.CString(qevt.Uuid)
+}
+
 //export GetQueuedEventRelayTries
 func GetQueuedEventRelayTries(piId int, queuedEventId int) int {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	qevt := a[piId].GetQueuedEvent(queuedEventId)
 	return qevt.RelayTries
 }
 
 //export GetQueuedEventEndpointStats
 func GetQueuedEventEndpointStats(piId int, queuedEventId int) uint {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	qevt := a[piId].GetQueuedEvent(queuedEventId)
 	return qevt.GetEndpointStats(a[piId]).ID
 }
 
 //export GetEndpointStatsCreatedAt
 func GetEndpointStatsCreatedAt(piId int, endpointStatsId int) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	estats := a[piId].GetEndpointStatsByID(endpointStatsId)
 	return estats.CreatedAt.UnixMicro()
 }
 
 //export GetEndpointStatsUpdatedAt
 func GetEndpointStatsUpdatedAt(piId int, endpointStatsId int) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	estats := a[piId].GetEndpointStatsByID(endpointStatsId)
 	return estats.UpdatedAt.UnixMicro()
 }
 
 //export GetEndpointStatsDeletedAt
 func GetEndpointStatsDeletedAt(piId int, endpointStatsId int) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	estats := a[piId].GetEndpointStatsByID(endpointStatsId)
 	if estats.DeletedAt.Valid {
 		return estats.DeletedAt.Time.UnixMicro()
@@ -373,12 +943,20 @@ func GetEndpointStatsDeletedAt(piId int, endpointStatsId int) int64 {
 
 //export GetEndpointStatsEndpoint
 func GetEndpointStatsEndpoint(piId int, endpointStatsId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	estats := a[piId].GetEndpointStatsByID(endpointStatsId)
 	return C.CString(estats.Endpoint)
 }
 
 //export GetEndpointStatsLastContactOut
 func GetEndpointStatsLastContactOut(piId int, endpointStatsId int) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	estats := a[piId].GetEndpointStatsByID(endpointStatsId)
 	return estats.LastContactOut.UnixMicro()
 }
@@ -391,18 +969,30 @@ func GetEndpointStatsLastContactOut(piId int, endpointStatsId int) int64 {
 
 //export GetEndpointStatsFailInRow
 func GetEndpointStatsFailInRow(piId int, endpointStatsId int) int {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	estats := a[piId].GetEndpointStatsByID(endpointStatsId)
 	return estats.FailInRow
 }
 
 //export GetEndpointStatsCurrentDelay
 func GetEndpointStatsCurrentDelay(piId int, endpointStatsId int) int {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	estats := a[piId].GetEndpointStatsByID(endpointStatsId)
 	return estats.CurrentDelay
 }
 
 //export CreateFile
 func CreateFile(piId int, uid int64, localFilePath *C.char, remoteFilePath *C.char) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	ui, err := a[piId].GetUserInfoByID(uint(uid))
 	if err != nil {
 		return C.CString(err.Error())
@@ -416,14 +1006,20 @@ func CreateFile(piId int, uid int64, localFilePath *C.char, remoteFilePath *C.ch
 
 //export GetSharedFilesIDs
 func GetSharedFilesIDs(piId int, uid int64) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
 	ui, err := a[piId].GetUserInfoByID(uint(uid))
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return C.CString("[]")
 	}
 	ids := a[piId].GetSharedFilesIDs(ui)
 	b, err := json.Marshal(ids)
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return C.CString("[]")
 	}
 	return C.CString(string(b))
 }
@@ -432,24 +1028,40 @@ func GetSharedFilesIDs(piId int, uid int64) *C.char {
 
 //export GetSharedFileID
 func GetSharedFileID(piId int, fileId uint) uint {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	f := a[piId].GetSharedFileById(fileId)
 	return f.ID
 }
 
 //export GetSharedFileCreatedAt
 func GetSharedFileCreatedAt(piId int, fileId uint) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	f := a[piId].GetSharedFileById(fileId)
 	return f.CreatedAt.UnixMicro()
 }
 
 //export GetSharedFileUpdatedAt
 func GetSharedFileUpdatedAt(piId int, fileId uint) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	f := a[piId].GetSharedFileById(fileId)
 	return f.UpdatedAt.UnixMicro()
 }
 
 //export GetSharedFileDeletedAt
 func GetSharedFileDeletedAt(piId int, fileId uint) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	f := a[piId].GetSharedFileById(fileId)
 	if !f.DeletedAt.Valid {
 		return 0
@@ -459,62 +1071,100 @@ func GetSharedFileDeletedAt(piId int, fileId uint) int64 {
 
 //export GetSharedFileSharedFor
 func GetSharedFileSharedFor(piId int, fileId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	f := a[piId].GetSharedFileById(fileId)
 	return C.CString(f.SharedFor)
 }
 
 //export GetSharedFileSha512Sum
 func GetSharedFileSha512Sum(piId int, fileId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	f := a[piId].GetSharedFileById(fileId)
 	return C.CString(f.Sha512Sum)
 }
 
 //export GetSharedFileLastEdit
 func GetSharedFileLastEdit(piId int, fileId uint) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	f := a[piId].GetSharedFileById(fileId)
 	return f.LastEdit.UnixMicro()
 }
 
 //export GetSharedFileFilePath
 func GetSharedFileFilePath(piId int, fileId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	f := a[piId].GetSharedFileById(fileId)
 	return C.CString(f.FilePath)
 }
 
 //export GetSharedFileLocalFilePath
 func GetSharedFileLocalFilePath(piId int, fileId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	f := a[piId].GetSharedFileById(fileId)
 	return C.CString(f.LocalFilePath)
 }
 
 //export GetSharedFileSizeBytes
 func GetSharedFileSizeBytes(piId int, fileId uint) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	f := a[piId].GetSharedFileById(fileId)
 	return f.SizeBytes
 }
 
 //export DeleteSharedFile
 func DeleteSharedFile(piId int, fileId uint) {
+	if !acquire(piId) {
+		return
+	}
+	defer a[piId].Release()
 	f := a[piId].GetSharedFileById(fileId)
 	a[piId].DeleteSharedFile(f)
 }
 
 //export GetUserInfoSharedFilesIDs
 func GetUserInfoSharedFilesIDs(piId int, uid int64) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
 	ui, err := a[piId].GetUserInfoByID(uint(uid))
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return C.CString("[]")
 	}
 	list := ui.GetReceivedSharedFilesMetadataIDs(a[piId])
 	b, err := json.Marshal(list)
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return C.CString("[]")
 	}
 	return C.CString(string(b))
 }
 
 //export GetReceivedSharedFilesMetadataID
 func GetReceivedSharedFilesMetadataID(piId int, uid uint) uint {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
 	sfm := a[piId].GetReceivedSharedFile(uid)
 	if sfm == nil {
 		return 0
@@ -529,6 +1179,10 @@ func GetReceivedSharedFilesMetadataID(piId int, uid uint) uint {
 
 //export GetReceivedSharedFilesMetadataDBKeyID
 func GetReceivedSharedFilesMetadataDBKeyID(piId int, uid uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	sfm := a[piId].GetReceivedSharedFile(uid)
 	if sfm == nil {
 		return C.CString("")
@@ -538,6 +1192,10 @@ func GetReceivedSharedFilesMetadataDBKeyID(piId int, uid uint) *C.char {
 
 //export GetReceivedSharedFilesMetadataKeyPart
 func GetReceivedSharedFilesMetadataKeyPart(piId int, uid uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	sfm := a[piId].GetReceivedSharedFile(uid)
 	if sfm == nil {
 		return C.CString("")
@@ -547,6 +1205,10 @@ func GetReceivedSharedFilesMetadataKeyPart(piId int, uid uint) *C.char {
 
 //export GetReceivedSharedFilesMetadataFilesEndpoint
 func GetReceivedSharedFilesMetadataFilesEndpoint(piId int, uid uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	sfm := a[piId].GetReceivedSharedFile(uid)
 	if sfm == nil {
 		return C.CString("")
@@ -556,9 +1218,661 @@ func GetReceivedSharedFilesMetadataFilesEndpoint(piId int, uid uint) *C.char {
 
 //export GetReceivedSharedFilesMetadataAuthentication
 func GetReceivedSharedFilesMetadataAuthentication(piId int, uid uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
 	sfm := a[piId].GetReceivedSharedFile(uid)
 	if sfm == nil {
 		return C.CString("")
 	}
 	return C.CString(sfm.Authentication)
 }
+
+// --------- Mailbox
+
+//export HostMailboxFor
+func HostMailboxFor(piId int, uid int64) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	a[piId].HostMailboxFor(ui)
+	return true
+}
+
+//export StopHostingMailboxFor
+func StopHostingMailboxFor(piId int, uid int64) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	a[piId].StopHostingMailboxFor(ui)
+	return true
+}
+
+//export AddMailbox
+func AddMailbox(piId int, endpoint *C.char, authentication *C.char) uint {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
+	mb := a[piId].AddMailbox("", core.Endpoint(C.GoString(endpoint)), C.GoString(authentication))
+	return mb.ID
+}
+
+//export DeleteMailbox
+func DeleteMailbox(piId int, mailboxId uint) {
+	if !acquire(piId) {
+		return
+	}
+	defer a[piId].Release()
+	mb := a[piId].GetMailboxByID(mailboxId)
+	if mb.ID == 0 {
+		log.Println("DeleteMailbox: unknown mailbox", mailboxId)
+		return
+	}
+	a[piId].DeleteMailbox(mb)
+}
+
+//export GetMailboxIDs
+func GetMailboxIDs(piId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
+	mbs := a[piId].GetMailboxes()
+	var ids = []uint{}
+	for i := range mbs {
+		ids = append(ids, mbs[i].ID)
+	}
+	b, err := json.Marshal(ids)
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	return C.CString(string(b))
+}
+
+//export GetMailboxEndpoint
+func GetMailboxEndpoint(piId int, mailboxId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	mb := a[piId].GetMailboxByID(mailboxId)
+	return C.CString(string(mb.Endpoint))
+}
+
+//export FetchMailboxes
+func FetchMailboxes(piId int) {
+	if !acquire(piId) {
+		return
+	}
+	defer a[piId].Release()
+	a[piId].FetchMailboxes()
+}
+
+//export GetQuarantinedInboundEventIDs
+func GetQuarantinedInboundEventIDs(piId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
+	ievts := a[piId].GetQuarantinedInboundEvents()
+	var ids = []uint{}
+	for i := range ievts {
+		ids = append(ids, ievts[i].ID)
+	}
+	b, err := json.Marshal(ids)
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	return C.CString(string(b))
+}
+
+//export GetInboundEventLastError
+func GetInboundEventLastError(piId int, inboundEventId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	ievt := a[piId].GetInboundEventByID(inboundEventId)
+	return C.CString(ievt.LastError)
+}
+
+//export RetryInboundEvent
+func RetryInboundEvent(piId int, inboundEventId uint) {
+	if !acquire(piId) {
+		return
+	}
+	defer a[piId].Release()
+	ievt := a[piId].GetInboundEventByID(inboundEventId)
+	a[piId].RetryInboundEvent(ievt)
+}
+
+//export DeleteInboundEvent
+func DeleteInboundEvent(piId int, inboundEventId uint) {
+	if !acquire(piId) {
+		return
+	}
+	defer a[piId].Release()
+	ievt := a[piId].GetInboundEventByID(inboundEventId)
+	a[piId].DeleteInboundEvent(ievt)
+}
+
+//export CreateInviteToken
+func CreateInviteToken(piId int, maxUses int, ttlSeconds int64, note *C.char) int {
+	if !acquire(piId) {
+		return -1
+	}
+	defer a[piId].Release()
+	it, err := a[piId].CreateInviteToken(maxUses, time.Duration(ttlSeconds)*time.Second, C.GoString(note))
+	if err != nil {
+		log.Println(err)
+		return -1
+	}
+	return int(it.ID)
+}
+
+//export GetInviteTokenIDs
+func GetInviteTokenIDs(piId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
+	its := a[piId].GetInviteTokens()
+	var ids = []uint{}
+	for i := range its {
+		ids = append(ids, its[i].ID)
+	}
+	b, err := json.Marshal(ids)
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	return C.CString(string(b))
+}
+
+//export GetInviteTokenToken
+func GetInviteTokenToken(piId int, inviteTokenId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	return C.CString(a[piId].GetInviteTokenByID(inviteTokenId).Token)
+}
+
+//export GetInviteTokenNote
+func GetInviteTokenNote(piId int, inviteTokenId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	return C.CString(a[piId].GetInviteTokenByID(inviteTokenId).Note)
+}
+
+//export GetInviteTokenExpiresAt
+func GetInviteTokenExpiresAt(piId int, inviteTokenId uint) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
+	it := a[piId].GetInviteTokenByID(inviteTokenId)
+	if it.ExpiresAt.IsZero() {
+		return 0
+	}
+	return it.ExpiresAt.Unix()
+}
+
+//export GetInviteTokenUses
+func GetInviteTokenUses(piId int, inviteTokenId uint) int {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
+	return a[piId].GetInviteTokenByID(inviteTokenId).Uses
+}
+
+//export GetInviteTokenMaxUses
+func GetInviteTokenMaxUses(piId int, inviteTokenId uint) int {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
+	return a[piId].GetInviteTokenByID(inviteTokenId).MaxUses
+}
+
+//export GetInviteTokenIsValid
+func GetInviteTokenIsValid(piId int, inviteTokenId uint) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	return a[piId].GetInviteTokenByID(inviteTokenId).IsValid()
+}
+
+//export GetInviteTokenHistory
+func GetInviteTokenHistory(piId int, inviteTokenId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
+	it := a[piId].GetInviteTokenByID(inviteTokenId)
+	b, err := json.Marshal(a[piId].GetInviteTokenUses(it))
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	return C.CString(string(b))
+}
+
+//export RevokeInviteToken
+func RevokeInviteToken(piId int, inviteTokenId uint) {
+	if !acquire(piId) {
+		return
+	}
+	defer a[piId].Release()
+	a[piId].RevokeInviteToken(a[piId].GetInviteTokenByID(inviteTokenId))
+}
+
+//export GetUserInfoState
+func GetUserInfoState(piId int, uid int) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err != nil {
+		log.Println(err)
+		return C.CString("")
+	}
+	return C.CString(ui.State)
+}
+
+//export GetUserInfoIDsByState
+func GetUserInfoIDsByState(piId int, state *C.char) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
+	uis := a[piId].GetUserInfoByState(C.GoString(state))
+	var ids = []uint{}
+	for i := range uis {
+		ids = append(ids, uis[i].ID)
+	}
+	b, err := json.Marshal(ids)
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	return C.CString(string(b))
+}
+
+//export AcceptUserInfo
+func AcceptUserInfo(piId int, uid int) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err == nil {
+		err = a[piId].AcceptUserInfo(ui)
+	}
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+//export RejectUserInfo
+func RejectUserInfo(piId int, uid int) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err == nil {
+		err = a[piId].RejectUserInfo(ui)
+	}
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+//export BlockUserInfo
+func BlockUserInfo(piId int, uid int) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err == nil {
+		err = a[piId].BlockUserInfo(ui)
+	}
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+//export GetIntroductionRequestIDs
+func GetIntroductionRequestIDs(piId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
+	irs := a[piId].GetIntroductionRequests()
+	var ids = []uint{}
+	for i := range irs {
+		ids = append(ids, irs[i].ID)
+	}
+	b, err := json.Marshal(ids)
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	return C.CString(string(b))
+}
+
+//export GetIntroductionRequestPublicKey
+func GetIntroductionRequestPublicKey(piId int, introductionRequestId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	return C.CString(a[piId].GetIntroductionRequestByID(introductionRequestId).PublicKey)
+}
+
+//export GetIntroductionRequestEndpoint
+func GetIntroductionRequestEndpoint(piId int, introductionRequestId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	return C.CString(string(a[piId].GetIntroductionRequestByID(introductionRequestId).Endpoint))
+}
+
+//export AcceptIntroductionRequest
+func AcceptIntroductionRequest(piId int, introductionRequestId uint) int {
+	if !acquire(piId) {
+		return -1
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].AcceptIntroductionRequest(a[piId].GetIntroductionRequestByID(introductionRequestId))
+	if err != nil {
+		log.Println(err)
+		return -1
+	}
+	return int(ui.ID)
+}
+
+//export DeleteIntroductionRequest
+func DeleteIntroductionRequest(piId int, introductionRequestId uint) {
+	if !acquire(piId) {
+		return
+	}
+	defer a[piId].Release()
+	a[piId].DeleteIntroductionRequest(a[piId].GetIntroductionRequestByID(introductionRequestId))
+}
+
+//export GetUserInfoRemoteFiles
+func GetUserInfoRemoteFiles(piId int, uid int) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	sfs, err := a[piId].GetRemoteFiles(ui)
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	b, err := json.Marshal(sfs)
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	return C.CString(string(b))
+}
+
+//export DownloadRemoteFile
+func DownloadRemoteFile(piId int, uid int, filePath *C.char) int {
+	if !acquire(piId) {
+		return -1
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err != nil {
+		log.Println(err)
+		return -1
+	}
+	d, err := a[piId].DownloadRemoteFile(ui, C.GoString(filePath))
+	if err != nil {
+		log.Println(err)
+		return -1
+	}
+	return int(d.ID)
+}
+
+//export GetUserInfoDownloadIDs
+func GetUserInfoDownloadIDs(piId int, uid int) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	ds := a[piId].GetDownloads(ui)
+	var ids = []uint{}
+	for i := range ds {
+		ids = append(ids, ds[i].ID)
+	}
+	b, err := json.Marshal(ids)
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	return C.CString(string(b))
+}
+
+//export GetDownloadFilePath
+func GetDownloadFilePath(piId int, downloadId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	return C.CString(a[piId].GetDownloadByID(downloadId).FilePath)
+}
+
+//export GetDownloadLocalFilePath
+func GetDownloadLocalFilePath(piId int, downloadId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	return C.CString(a[piId].GetDownloadByID(downloadId).LocalFilePath)
+}
+
+//export GetDownloadStatus
+func GetDownloadStatus(piId int, downloadId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	return C.CString(a[piId].GetDownloadByID(downloadId).Status)
+}
+
+//export GetDownloadBytesDone
+func GetDownloadBytesDone(piId int, downloadId uint) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
+	return a[piId].GetDownloadByID(downloadId).BytesDone
+}
+
+//export GetDownloadSizeBytes
+func GetDownloadSizeBytes(piId int, downloadId uint) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
+	return a[piId].GetDownloadByID(downloadId).SizeBytes
+}
+
+//export GetDownloadLastError
+func GetDownloadLastError(piId int, downloadId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	return C.CString(a[piId].GetDownloadByID(downloadId).LastError)
+}
+
+//export AddSyncFolder
+func AddSyncFolder(piId int, uid int, name *C.char, localPath *C.char) int {
+	if !acquire(piId) {
+		return -1
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err != nil {
+		log.Println(err)
+		return -1
+	}
+	sfo, err := a[piId].AddSyncFolder(ui, C.GoString(name), C.GoString(localPath))
+	if err != nil {
+		log.Println(err)
+		return -1
+	}
+	return int(sfo.ID)
+}
+
+//export GetSyncFolderIDs
+func GetSyncFolderIDs(piId int) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
+	sfos := a[piId].GetSyncFolders()
+	var ids = []uint{}
+	for i := range sfos {
+		ids = append(ids, sfos[i].ID)
+	}
+	b, err := json.Marshal(ids)
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	return C.CString(string(b))
+}
+
+//export GetSyncFolderKeyID
+func GetSyncFolderKeyID(piId int, syncFolderId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	return C.CString(a[piId].GetSyncFolderByID(syncFolderId).DBKeyID)
+}
+
+//export GetSyncFolderName
+func GetSyncFolderName(piId int, syncFolderId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	return C.CString(a[piId].GetSyncFolderByID(syncFolderId).Name)
+}
+
+//export GetSyncFolderLocalPath
+func GetSyncFolderLocalPath(piId int, syncFolderId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	return C.CString(a[piId].GetSyncFolderByID(syncFolderId).LocalPath)
+}
+
+//export GetSyncFolderLastSync
+func GetSyncFolderLastSync(piId int, syncFolderId uint) int64 {
+	if !acquire(piId) {
+		return 0
+	}
+	defer a[piId].Release()
+	return a[piId].GetSyncFolderByID(syncFolderId).LastSync.UnixMicro()
+}
+
+//export GetSyncFolderLastError
+func GetSyncFolderLastError(piId int, syncFolderId uint) *C.char {
+	if !acquire(piId) {
+		return C.CString("")
+	}
+	defer a[piId].Release()
+	return C.CString(a[piId].GetSyncFolderByID(syncFolderId).LastError)
+}
+
+//export DeleteSyncFolder
+func DeleteSyncFolder(piId int, syncFolderId uint) {
+	if !acquire(piId) {
+		return
+	}
+	defer a[piId].Release()
+	a[piId].DeleteSyncFolder(a[piId].GetSyncFolderByID(syncFolderId))
+}
+
+//export SyncFolderNow
+func SyncFolderNow(piId int, syncFolderId uint) bool {
+	if !acquire(piId) {
+		return false
+	}
+	defer a[piId].Release()
+	err := a[piId].SyncFolderNow(a[piId].GetSyncFolderByID(syncFolderId))
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+//export GetUserInfoCachedRemoteFiles
+func GetUserInfoCachedRemoteFiles(piId int, uid int) *C.char {
+	if !acquire(piId) {
+		return C.CString("[]")
+	}
+	defer a[piId].Release()
+	ui, err := a[piId].GetUserInfoByID(uint(uid))
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	b, err := json.Marshal(a[piId].GetCachedRemoteFiles(ui))
+	if err != nil {
+		log.Println(err)
+		return C.CString("[]")
+	}
+	return C.CString(string(b))
+}